@@ -4,7 +4,14 @@ import (
 	"crypto/rand"
 	"encoding/hex"
 	"fmt"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
 	"strings"
+	"syscall"
+	"time"
 
 	"github.com/codeallthethingz/secrets/model"
 	"github.com/logrusorgru/aurora"
@@ -13,10 +20,11 @@ import (
 
 // RevokeService remove all access for this service
 func RevokeService(c *cli.Context) error {
-	serviceName, _, passphrase, secretsFile, err := check1or2Args(c, "service name", "")
+	serviceName, _, secretsFile, err := check1or2Args(c, "service name", "", exclusiveLock)
 	if err != nil {
 		return cli.NewExitError(err, 1)
 	}
+	defer secretsFile.Close()
 	if _, ok := secretsFile.HasService(serviceName); !ok {
 		fmt.Println(aurora.Green("revoked"))
 		return nil
@@ -30,7 +38,11 @@ func RevokeService(c *cli.Context) error {
 	secretsFile.Services = newServices
 	secrets := getAllSecretNames(secretsFile)
 	removeServiceFromSecrets(serviceName, secrets, secretsFile)
-	secretsFile.Save(passphrase)
+	err = save(secretsFile, 1)
+	if err != nil {
+		return err
+	}
+	fmt.Println(aurora.Green("revoked"))
 	return nil
 }
 
@@ -44,17 +56,18 @@ func getAllSecretNames(secretsFile *model.SecretsFile) string {
 
 // RemoveAccess remove this serice from accessing any secrets
 func RemoveAccess(c *cli.Context) error {
-	serviceName, secrets, passphrase, secretsFile, err := check1or2Args(c, "service name", "secrets")
+	serviceName, secrets, secretsFile, err := check1or2Args(c, "service name", "secrets", exclusiveLock)
 	if err != nil {
 		return cli.NewExitError(err, 1)
 	}
+	defer secretsFile.Close()
 
 	if _, ok := secretsFile.HasService(serviceName); !ok {
 		fmt.Println(aurora.Green("removed"))
 		return nil
 	}
 	removeServiceFromSecrets(serviceName, secrets, secretsFile)
-	err = secretsFile.Save(passphrase)
+	err = save(secretsFile, 1)
 	if err != nil {
 		return err
 	}
@@ -81,21 +94,27 @@ func removeServiceFromSecrets(serviceName string, secrets string, secretsFile *m
 
 // AddAccess add an access token to a secret
 func AddAccess(c *cli.Context) error {
-	serviceName, secrets, passphrase, secretsFile, err := check1or2Args(c, "service name", "secrets")
+	serviceName, secrets, secretsFile, err := check1or2Args(c, "service name", "secrets", exclusiveLock)
 	if err != nil {
 		return cli.NewExitError(err, 1)
 	}
+	defer secretsFile.Close()
 	generatedToken, err := generateRandomHexBytes(50)
 	if err != nil {
 		return cli.NewExitError(err, 1)
 	}
 	if service, serviceExists := secretsFile.HasService(serviceName); serviceExists {
+		if c.Bool("hash-token") && !service.Hashed() {
+			return cli.NewExitError("service "+serviceName+" already has an encrypted token, use rotate-token --hash-token to hash it", 1)
+		}
 		generatedToken = service.Secret
 	} else {
-		secretsFile.Services = append(secretsFile.Services, &model.Service{
-			Name:   serviceName,
-			Secret: generatedToken,
-		})
+		service := &model.Service{Name: serviceName}
+		err = service.SetToken(generatedToken, c.Bool("hash-token"))
+		if err != nil {
+			return cli.NewExitError(err, 1)
+		}
+		secretsFile.Services = append(secretsFile.Services, service)
 	}
 	arrayOfSecrets := strings.Split(secrets, ",")
 	for _, secretName := range arrayOfSecrets {
@@ -108,156 +127,1052 @@ func AddAccess(c *cli.Context) error {
 			secretsFile.Secrets[i].Access = append(secretsFile.Secrets[i].Access, serviceName)
 		}
 	}
-	err = secretsFile.Save(passphrase)
+	err = save(secretsFile, 13)
 	if err != nil {
-		return cli.NewExitError(err, 13)
+		return err
 	}
 	fmt.Printf(aurora.Green("added access to %s for %s\n").String(), aurora.Blue(serviceName), aurora.BrightBlue(secrets))
-	fmt.Println("Please use this token to access the secrets serice through the api")
-	fmt.Println(aurora.Yellow(string(generatedToken)))
+	if generatedToken == nil {
+		fmt.Println("The token for this service is hashed and can't be shown, use rotate-token to issue a new one")
+		return nil
+	}
+	printToken(generatedToken)
+	return nil
+}
+
+// RotateToken issue a new token for a service, the old token stops working
+func RotateToken(c *cli.Context) error {
+	serviceName, _, secretsFile, err := check1or2Args(c, "service name", "", exclusiveLock)
+	if err != nil {
+		return cli.NewExitError(err, 1)
+	}
+	defer secretsFile.Close()
+	service, ok := secretsFile.HasService(serviceName)
+	if !ok {
+		return cli.NewExitError("could not find service: "+serviceName, 1)
+	}
+	generatedToken, err := generateRandomHexBytes(50)
+	if err != nil {
+		return cli.NewExitError(err, 1)
+	}
+	err = service.SetToken(generatedToken, service.Hashed() || c.Bool("hash-token"))
+	if err != nil {
+		return cli.NewExitError(err, 1)
+	}
+	err = save(secretsFile, 1)
+	if err != nil {
+		return err
+	}
+	fmt.Printf(aurora.Green("rotated token for %s\n").String(), aurora.Blue(serviceName))
+	printToken(generatedToken)
 	return nil
 }
 
-// Passphrase change to a new passphrase
+func printToken(token []byte) {
+	fmt.Println("Please use this token to access the secrets serice through the api")
+	fmt.Println(aurora.Yellow(string(token)))
+}
+
+// Passphrase change to a new passphrase, it's read before the file is
+// locked and only once when the change is re-applied on a conflict
 func Passphrase(c *cli.Context) error {
-	newPassphrase, _, _, secretsFile, err := check1or2Args(c, "new passphrase", "")
+	newPassphrase, err := readNewPassphrase(c, c.Args().Get(0), "new passphrase")
+	if err != nil {
+		return cli.NewExitError(err, 1)
+	}
+	return rebaseOnConflict(func(c *cli.Context) error { return changePassphrase(c, newPassphrase) })(c)
+}
+
+func changePassphrase(c *cli.Context, newPassphrase string) error {
+	_, _, secretsFile, err := check1or2Args(c, "", "", exclusiveLock)
 	if err != nil {
 		return cli.NewExitError(err, 1)
 	}
-	secretsFile.Save(newPassphrase)
+	defer secretsFile.Close()
+	err = secretsFile.ChangePassphrase(newPassphrase)
+	if err != nil {
+		return cli.NewExitError(err, 1)
+	}
+	err = save(secretsFile, 1)
+	if err != nil {
+		return err
+	}
 	fmt.Println(aurora.Green("changed passphrase"))
 	return nil
 }
 
+// SlotAdd add a key slot with another passphrase
+func SlotAdd(c *cli.Context) error {
+	if strings.TrimSpace(c.Args().Get(0)) == "" {
+		return cli.NewExitError("must specify slot name as first argument", 1)
+	}
+	slotPassphrase, err := readNewPassphrase(c, c.Args().Get(1), "slot passphrase")
+	if err != nil {
+		return cli.NewExitError(err, 1)
+	}
+	return rebaseOnConflict(func(c *cli.Context) error { return addSlot(c, slotPassphrase) })(c)
+}
+
+func addSlot(c *cli.Context, slotPassphrase string) error {
+	name, _, secretsFile, err := check1or2Args(c, "slot name", "", exclusiveLock)
+	if err != nil {
+		return cli.NewExitError(err, 1)
+	}
+	defer secretsFile.Close()
+	err = secretsFile.AddSlot(name, slotPassphrase)
+	if err != nil {
+		return cli.NewExitError(err, 1)
+	}
+	err = save(secretsFile, 1)
+	if err != nil {
+		return err
+	}
+	fmt.Printf(aurora.Green("added slot %s\n").String(), aurora.White(name))
+	return nil
+}
+
+// SlotList list the key slots
+func SlotList(c *cli.Context) error {
+	_, _, secretsFile, err := check1or2Args(c, "", "", sharedLock)
+	if err != nil {
+		return cli.NewExitError(err, 1)
+	}
+	defer secretsFile.Close()
+	for _, slot := range secretsFile.Slots {
+		if slot.Name == secretsFile.UnlockedSlot() {
+			fmt.Printf("%s %s\n", aurora.White(slot.Name), aurora.Green("(unlocked)"))
+		} else {
+			fmt.Println(aurora.White(slot.Name))
+		}
+	}
+	return nil
+}
+
+// SlotRemove remove a key slot
+func SlotRemove(c *cli.Context) error {
+	name, _, secretsFile, err := check1or2Args(c, "slot name", "", exclusiveLock)
+	if err != nil {
+		return cli.NewExitError(err, 1)
+	}
+	defer secretsFile.Close()
+	err = secretsFile.RemoveSlot(name)
+	if err != nil {
+		return cli.NewExitError(err, 1)
+	}
+	err = save(secretsFile, 1)
+	if err != nil {
+		return err
+	}
+	fmt.Printf(aurora.Green("removed slot %s\n").String(), aurora.White(name))
+	return nil
+}
+
+// RecipientAdd add a public key that can unlock the file
+func RecipientAdd(c *cli.Context) error {
+	name, publicKey, secretsFile, err := check1or2Args(c, "recipient name", "public key", exclusiveLock)
+	if err != nil {
+		return cli.NewExitError(err, 1)
+	}
+	defer secretsFile.Close()
+	err = secretsFile.AddRecipient(name, publicKey)
+	if err != nil {
+		return cli.NewExitError(err, 1)
+	}
+	err = save(secretsFile, 1)
+	if err != nil {
+		return err
+	}
+	fmt.Printf(aurora.Green("added recipient %s\n").String(), aurora.White(name))
+	return nil
+}
+
+// RecipientList list the recipients
+func RecipientList(c *cli.Context) error {
+	_, _, secretsFile, err := check1or2Args(c, "", "", sharedLock)
+	if err != nil {
+		return cli.NewExitError(err, 1)
+	}
+	defer secretsFile.Close()
+	if len(secretsFile.Recipients) == 0 {
+		fmt.Println(aurora.White("empty"))
+		return nil
+	}
+	for _, recipient := range secretsFile.Recipients {
+		fmt.Printf("%s: %s\n", aurora.White(recipient.Name), aurora.Blue(recipient.PublicKey))
+	}
+	return nil
+}
+
+// RecipientRemove remove a recipient
+func RecipientRemove(c *cli.Context) error {
+	name, _, secretsFile, err := check1or2Args(c, "recipient name", "", exclusiveLock)
+	if err != nil {
+		return cli.NewExitError(err, 1)
+	}
+	defer secretsFile.Close()
+	err = secretsFile.RemoveRecipient(name)
+	if err != nil {
+		return cli.NewExitError(err, 1)
+	}
+	err = save(secretsFile, 1)
+	if err != nil {
+		return err
+	}
+	fmt.Printf(aurora.Green("removed recipient %s\n").String(), aurora.White(name))
+	return nil
+}
+
+// RecipientKeygen generate a new identity file
+func RecipientKeygen(c *cli.Context) error {
+	file := strings.TrimSpace(c.Args().Get(0))
+	if len(file) == 0 {
+		return cli.NewExitError("must specify identity file as first argument", 1)
+	}
+	if _, err := os.Stat(file); err == nil {
+		return cli.NewExitError("identity file already exists: "+file, 1)
+	}
+	identity, err := model.GenerateIdentity()
+	if err != nil {
+		return cli.NewExitError(err, 1)
+	}
+	err = identity.Save(file)
+	if err != nil {
+		return cli.NewExitError(err, 1)
+	}
+	fmt.Printf(aurora.Green("created %s, public key:\n").String(), aurora.White(file))
+	fmt.Println(aurora.Yellow(identity.PublicKey()))
+	return nil
+}
+
 // Remove a secret from the file secrets.json
 func Remove(c *cli.Context) error {
-	name, _, passphrase, secretsFile, err := check1or2Args(c, "secret name", "")
+	name, _, secretsFile, err := check1or2Args(c, "secret name", "", exclusiveLock)
 	if err != nil {
 		return cli.NewExitError(err, 1)
 	}
+	defer secretsFile.Close()
 	i := secretsFile.IndexOfSecret(name)
 	if i == -1 {
 		fmt.Println(aurora.Red("not found, so removed"))
 		return nil
 	}
 	secretsFile.Secrets = append(secretsFile.Secrets[:i], secretsFile.Secrets[i+1:]...)
-	secretsFile.Save(passphrase)
+	err = save(secretsFile, 1)
+	if err != nil {
+		return err
+	}
 	fmt.Println(aurora.Green("removed"))
 	return nil
 }
 
-func check1or2Args(c *cli.Context, arg1Name string, arg2Name string) (string, string, string, *model.SecretsFile, error) {
-	passphrase := strings.TrimSpace(c.GlobalString("passphrase"))
-	if len(passphrase) == 0 {
-		return "", "", "", nil, fmt.Errorf("must specify --passphrase")
+// Migrate convert the secrets file to another format version
+func Migrate(c *cli.Context) error {
+	file, err := secretsFileName(c)
+	if err != nil {
+		return cli.NewExitError(err, 1)
+	}
+	lock, err := model.LockSecretsFile(file, exclusiveLock, c.GlobalDuration("lock-timeout"))
+	if err != nil {
+		return cli.NewExitError(err, 1)
+	}
+	defer lock.Unlock()
+	to := c.Int("to")
+	applied, err := model.MigrateFile(file, to, c.Bool("dry-run"))
+	if err != nil {
+		return cli.NewExitError(err, 1)
+	}
+	if len(applied) == 0 {
+		fmt.Printf(aurora.Green("already at version %d\n").String(), aurora.White(to))
+		return nil
+	}
+	for _, migration := range applied {
+		fmt.Printf("%s: %s\n", aurora.White(fmt.Sprintf("v%d -> v%d", migration.From, migration.To())), migration.Description)
+	}
+	if c.Bool("dry-run") {
+		fmt.Println(aurora.Yellow("dry run, file not changed"))
+		return nil
+	}
+	fmt.Printf(aurora.Green("migrated to version %d\n").String(), aurora.White(to))
+	return nil
+}
+
+// Convert copy the secrets file into another store, such as between the
+// JSON format and SQLite
+func Convert(c *cli.Context) error {
+	file, err := secretsFileName(c)
+	if err != nil {
+		return cli.NewExitError(err, 1)
+	}
+	destination := c.Args().Get(0)
+	if strings.TrimSpace(destination) == "" {
+		return cli.NewExitError("must specify the destination, a path or a file://, s3:// or sqlite:// URL", 1)
+	}
+	lock, err := model.LockSecretsFile(file, sharedLock, c.GlobalDuration("lock-timeout"))
+	if err != nil {
+		return cli.NewExitError(err, 1)
+	}
+	defer lock.Unlock()
+	destinationLock, err := model.LockSecretsFile(destination, exclusiveLock, c.GlobalDuration("lock-timeout"))
+	if err != nil {
+		return cli.NewExitError(err, 1)
+	}
+	defer destinationLock.Unlock()
+	err = model.ConvertSecretsFile(file, destination)
+	if err != nil {
+		return cli.NewExitError(err, 1)
+	}
+	fmt.Printf(aurora.Green("converted %s to %s\n").String(), aurora.White(file), aurora.White(destination))
+	return nil
+}
+
+// Agent hold the keys of unlocked files until it is interrupted
+func Agent(c *cli.Context) error {
+	listener, err := model.ListenAgent(model.AgentSocket())
+	if err != nil {
+		return cli.NewExitError(err, 1)
+	}
+	socket := listener.Addr().String()
+	if model.AgentSocket() == "" {
+		// the directory was made for this agent
+		defer os.Remove(filepath.Dir(socket))
+	}
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-signals
+		listener.Close()
+	}()
+	fmt.Printf("%s=%s; export %s\n", model.AgentSocketEnv, socket, model.AgentSocketEnv)
+	err = model.NewAgent(c.Duration("idle-timeout")).Serve(listener)
+	if err != nil {
+		return cli.NewExitError(err, 1)
+	}
+	return nil
+}
+
+// Unlock give the agent the key of the secrets file
+func Unlock(c *cli.Context) error {
+	_, _, secretsFile, err := check1or2Args(c, "", "", sharedLock)
+	if err != nil {
+		return cli.NewExitError(err, 1)
+	}
+	defer secretsFile.Close()
+	err = secretsFile.AddToAgent()
+	if err != nil {
+		return cli.NewExitError(fmt.Errorf("could not reach the agent, is secrets agent running? %v", err), 1)
+	}
+	fmt.Println(aurora.Green("unlocked"))
+	return nil
+}
+
+// Lock make the agent forget the key of the secrets file, or of every file
+func Lock(c *cli.Context) error {
+	file := ""
+	if !c.Bool("all") {
+		var err error
+		file, err = secretsFileName(c)
+		if err != nil {
+			return cli.NewExitError(err, 1)
+		}
+	}
+	dropped, err := model.LockAgent(file)
+	if err != nil {
+		return cli.NewExitError(fmt.Errorf("could not reach the agent, is secrets agent running? %v", err), 1)
+	}
+	if dropped == 0 {
+		fmt.Println(aurora.Yellow("was not unlocked"))
+		return nil
+	}
+	fmt.Println(aurora.Green("locked"))
+	return nil
+}
+
+// Verify check the integrity of every entry in the secrets file
+func Verify(c *cli.Context) error {
+	key, err := unlockKey(c)
+	if err != nil {
+		return cli.NewExitError(err, 1)
+	}
+	file, err := secretsFileName(c)
+	if err != nil {
+		return cli.NewExitError(err, 1)
+	}
+	lock, err := model.LockSecretsFile(file, sharedLock, c.GlobalDuration("lock-timeout"))
+	if err != nil {
+		return cli.NewExitError(err, 1)
+	}
+	defer lock.Unlock()
+	problems, err := model.VerifySecretsFile(file, key)
+	if err != nil {
+		return cli.NewExitError(err, 1)
+	}
+	for _, problem := range problems {
+		fmt.Println(aurora.Red(problem.Error()))
+	}
+	if len(problems) > 0 {
+		return cli.NewExitError(fmt.Sprintf("%d integrity problems found", len(problems)), 1)
+	}
+	fmt.Println(aurora.Green("ok"))
+	return nil
+}
+
+// Versions list the versions of the secrets file that its store keeps
+func Versions(c *cli.Context) error {
+	file, err := secretsFileName(c)
+	if err != nil {
+		return cli.NewExitError(err, 1)
+	}
+	store, err := model.OpenStore(file)
+	if err != nil {
+		return cli.NewExitError(err, 1)
+	}
+	versions, err := store.Versions()
+	if err != nil {
+		return cli.NewExitError(err, 1)
+	}
+	for _, version := range versions {
+		current := ""
+		if version.Current {
+			current = aurora.Green(" (current)").String()
+		}
+		fmt.Printf("%s %s%s\n", aurora.White(version.Version), version.Modified.Format(time.RFC3339), current)
+	}
+	return nil
+}
+
+func secretsFileName(c *cli.Context) (string, error) {
+	file := c.GlobalString("secrets-file")
+	if strings.TrimSpace(file) == "" {
+		return "", fmt.Errorf("Must set a value for --secrets-file if used")
+	}
+	return file, nil
+}
+
+// conflictError explains how to get past a save that lost a race with
+// another change to the file
+type conflictError struct {
+	err *model.ConflictError
+}
+
+func (e *conflictError) Error() string {
+	return e.err.Error() + "\nrun the command again, or pass --on-conflict rebase to re-apply it to the latest revision"
+}
+
+// ExitCode so that scripts can tell a conflict from other failures
+func (e *conflictError) ExitCode() int {
+	return 3
+}
+
+// save the secrets file, turning errors into exit errors with the code
+func save(secretsFile *model.SecretsFile, exitCode int) error {
+	err := secretsFile.Save()
+	if conflict, ok := err.(*model.ConflictError); ok {
+		return &conflictError{err: conflict}
 	}
+	if err != nil {
+		return cli.NewExitError(err, exitCode)
+	}
+	return nil
+}
+
+const maxRebases = 3
+
+// rebaseOnConflict re-runs a command that changes the secrets file when its
+// save conflicted with another change and --on-conflict rebase was given.
+// Every command loads the latest revision, so running it again re-applies
+// the change on top of it.
+func rebaseOnConflict(action func(*cli.Context) error) func(*cli.Context) error {
+	return func(c *cli.Context) error {
+		if onConflict := c.GlobalString("on-conflict"); onConflict != "fail" && onConflict != "rebase" {
+			return cli.NewExitError("--on-conflict must be fail or rebase", 1)
+		}
+		err := action(c)
+		for i := 0; i < maxRebases; i++ {
+			if _, ok := err.(*conflictError); !ok || c.GlobalString("on-conflict") != "rebase" {
+				return err
+			}
+			fmt.Println(aurora.Yellow("secrets file changed while saving, re-applying to the latest revision"))
+			err = action(c)
+		}
+		return err
+	}
+}
+
+const (
+	sharedLock    = false
+	exclusiveLock = true
+)
+
+// check1or2Args validates the arguments and opens the secrets file, holding
+// an exclusive lock for commands that change it and a shared lock for reads.
+// Callers must Close the secrets file.
+func check1or2Args(c *cli.Context, arg1Name string, arg2Name string, exclusive bool) (string, string, *model.SecretsFile, error) {
 	arg1, arg2 := "", ""
 	if arg1Name != "" {
 		arg1 = strings.TrimSpace(c.Args().Get(0))
 		if len(arg1) == 0 {
-			return "", "", "", nil, fmt.Errorf("must specify %s as first argument", arg1Name)
+			return "", "", nil, fmt.Errorf("must specify %s as first argument", arg1Name)
 		}
 	}
 	if arg2Name != "" {
 		arg2 = strings.TrimSpace(c.Args().Get(1))
 		if len(arg2) == 0 {
-			return "", "", "", nil, fmt.Errorf("must specify %s as second argument", arg2Name)
+			return "", "", nil, fmt.Errorf("must specify %s as second argument", arg2Name)
 		}
 	}
-	file := c.GlobalString("secrets-file")
-	if strings.TrimSpace(file) == "" {
-		return "", "", "", nil, fmt.Errorf("Must set a value for --secrets-file if used")
+	file, err := secretsFileName(c)
+	if err != nil {
+		return "", "", nil, err
+	}
+	// an unlocked file doesn't need the passphrase, unless a key is given
+	if !keyGiven(c) {
+		if key, ok := model.AgentKey(file); ok {
+			secretsFile, err := model.OpenSecretsFile(file, key, exclusive, c.GlobalDuration("lock-timeout"))
+			if err == nil {
+				return arg1, arg2, secretsFile, nil
+			}
+		}
 	}
-	secretsFile, err := model.LoadOrCreateSecretsFile(file, passphrase)
+	key, err := unlockKey(c)
 	if err != nil {
-		return "", "", "", nil, err
+		return "", "", nil, err
+	}
+	secretsFile, err := model.OpenSecretsFile(file, key, exclusive, c.GlobalDuration("lock-timeout"))
+	if err != nil {
+		return "", "", nil, err
 	}
 
-	return arg1, arg2, passphrase, secretsFile, nil
+	return arg1, arg2, secretsFile, nil
+}
+
+// keyGiven returns true if a passphrase or identity was given in any of the
+// ways unlockKey takes one, other than asking for it
+func keyGiven(c *cli.Context) bool {
+	for _, flag := range []string{"passphrase", "identity", "passphrase-file", "passphrase-command"} {
+		if strings.TrimSpace(c.GlobalString(flag)) != "" {
+			return true
+		}
+	}
+	return os.Getenv(passphraseEnv) != ""
+}
+
+// unlockKey the passphrase if there is one, otherwise the identity
+func unlockKey(c *cli.Context) (model.Key, error) {
+	passphrase := strings.TrimSpace(c.GlobalString("passphrase"))
+	if len(passphrase) != 0 {
+		return model.Passphrase(passphrase), nil
+	}
+	identityFile := strings.TrimSpace(c.GlobalString("identity"))
+	if len(identityFile) != 0 {
+		identity, err := model.LoadIdentity(identityFile)
+		if err != nil {
+			return nil, err
+		}
+		return identity, nil
+	}
+	passphrase, err := resolvePassphrase(c)
+	if err != nil {
+		return nil, err
+	}
+	// a rebase runs the command again, it shouldn't ask again
+	if err := c.GlobalSet("passphrase", passphrase); err != nil {
+		return nil, err
+	}
+	return model.Passphrase(passphrase), nil
+}
+
+// resolvePassphrase finds the passphrase when --passphrase isn't given, from
+// SECRETS_PASSPHRASE, --passphrase-file, the stdout of --passphrase-command
+// or, last, by asking for it
+func resolvePassphrase(c *cli.Context) (string, error) {
+	passphrase, ok, err := passphraseFrom(passphraseEnv, c.GlobalString("passphrase-file"), "passphrase-command", c.GlobalString("passphrase-command"))
+	switch {
+	case err != nil:
+		return "", err
+	case ok:
+	case isTerminal():
+		file, err := secretsFileName(c)
+		if err != nil {
+			return "", err
+		}
+		exists, err := model.SecretsFileExists(file)
+		if err != nil {
+			return "", err
+		}
+		var typed []byte
+		if exists {
+			typed, err = prompt("passphrase")
+		} else {
+			// a typo would lock the new file with a passphrase no one knows
+			typed, err = promptTwice("passphrase")
+		}
+		if err != nil {
+			return "", err
+		}
+		passphrase = string(typed)
+	default:
+		return "", fmt.Errorf("must specify --passphrase, %s, --passphrase-file, --passphrase-command or --identity", passphraseEnv)
+	}
+	passphrase = strings.TrimSpace(passphrase)
+	if len(passphrase) == 0 {
+		return "", fmt.Errorf("passphrase is empty")
+	}
+	return passphrase, nil
+}
+
+// passphraseFrom reads a passphrase from the environment variable, the file
+// or the stdout of the command, whichever is set first. Returns false when
+// none of them are.
+func passphraseFrom(env string, file string, commandFlag string, command string) (string, bool, error) {
+	switch {
+	case os.Getenv(env) != "":
+		return os.Getenv(env), true, nil
+	case file != "":
+		contents, err := ioutil.ReadFile(file)
+		if err != nil {
+			return "", false, err
+		}
+		return string(contents), true, nil
+	case command != "":
+		out, err := passphraseCommand(command).Output()
+		if err != nil {
+			return "", false, fmt.Errorf("--%s failed: %v", commandFlag, err)
+		}
+		return string(out), true, nil
+	}
+	return "", false, nil
+}
+
+// readNewPassphrase the passphrase change-passphrase and slot add set, from
+// the argument, which shows up in the shell history and ps and is best
+// avoided, SECRETS_NEW_PASSPHRASE, --new-passphrase-file, the stdout of
+// --new-passphrase-command or, last, typed twice
+func readNewPassphrase(c *cli.Context, arg string, label string) (string, error) {
+	passphrase, ok, err := arg, true, error(nil)
+	if strings.TrimSpace(arg) == "" {
+		passphrase, ok, err = passphraseFrom(newPassphraseEnv, c.String("new-passphrase-file"), "new-passphrase-command", c.String("new-passphrase-command"))
+	}
+	switch {
+	case err != nil:
+		return "", err
+	case ok:
+	case isTerminal():
+		typed, err := promptTwice(label)
+		if err != nil {
+			return "", err
+		}
+		passphrase = string(typed)
+	default:
+		return "", fmt.Errorf("must specify the %s with %s, --new-passphrase-file or --new-passphrase-command", label, newPassphraseEnv)
+	}
+	passphrase = strings.TrimSpace(passphrase)
+	if len(passphrase) == 0 {
+		return "", fmt.Errorf("%s is empty", label)
+	}
+	return passphrase, nil
 }
 
 // Set add a secret to the file secrets.json
 func Set(c *cli.Context) error {
-	name, secret, passphrase, secretsFile, err := check1or2Args(c, "secret name", "secret value")
+	value, err := secretValue(c, c.String("generate"))
 	if err != nil {
 		return cli.NewExitError(err, 1)
 	}
-	i := secretsFile.IndexOfSecret(name)
-	newSecret := model.Secret{
-		Name:   name,
-		Secret: []byte(secret),
+	return rebaseOnConflict(func(c *cli.Context) error { return setSecret(c, value) })(c)
+}
+
+// Generate add a secret with a generated value
+func Generate(c *cli.Context) error {
+	value, err := secretValue(c, c.String("type"))
+	if err != nil {
+		return cli.NewExitError(err, 1)
 	}
-	if i == -1 {
-		secretsFile.Secrets = append(secretsFile.Secrets, &newSecret)
-	} else {
-		access := secretsFile.Secrets[i].Access
-		newSecret.Access = access
-		secretsFile.Secrets[i] = &newSecret
+	return rebaseOnConflict(func(c *cli.Context) error { return setSecret(c, value) })(c)
+}
+
+// secretValue works out the value to set once, before the secrets file is
+// locked, so a rebase doesn't read stdin or prompt again. The value comes
+// from the generator, --from-file, stdin when it's -, the argument, or a
+// prompt when there's none.
+func secretValue(c *cli.Context, generator string) (*generated, error) {
+	if strings.TrimSpace(c.Args().Get(0)) == "" {
+		return nil, fmt.Errorf("must specify secret name as first argument")
+	}
+	arg := strings.TrimSpace(c.Args().Get(1))
+	fromFile := c.String("from-file")
+	sources := 0
+	for _, given := range []bool{generator != "", fromFile != "", arg != ""} {
+		if given {
+			sources++
+		}
+	}
+	if sources > 1 {
+		return nil, fmt.Errorf("give only one of a secret value, --from-file or a generator")
+	}
+	var value []byte
+	var err error
+	switch {
+	case generator != "":
+		return generate(generator, generatorOptions{
+			length:  c.Int("length"),
+			classes: c.String("classes"),
+			bits:    c.Int("bits"),
+			curve:   c.String("curve"),
+		})
+	case fromFile != "":
+		value, err = ioutil.ReadFile(fromFile)
+	case arg == "-":
+		value, err = readStdin()
+	case arg != "":
+		value = []byte(arg)
+	default:
+		value, err = promptTwice("secret value")
 	}
-	err = secretsFile.Save(passphrase)
 	if err != nil {
-		return cli.NewExitError(err, 8)
+		return nil, err
 	}
-	if i == -1 {
+	if len(value) == 0 {
+		return nil, fmt.Errorf("secret value is empty")
+	}
+	return &generated{value: value}, nil
+}
+
+// setSecret sets the secret to the value, and its metadata from the flags
+func setSecret(c *cli.Context, value *generated) error {
+	name, _, secretsFile, err := check1or2Args(c, "secret name", "", exclusiveLock)
+	if err != nil {
+		return cli.NewExitError(err, 1)
+	}
+	defer secretsFile.Close()
+	tags, err := model.ParseTags(c.StringSlice("tag"))
+	if err != nil {
+		return cli.NewExitError(err, 1)
+	}
+	newSecret, added, err := secretsFile.SetSecret(name, value.value)
+	if err != nil {
+		return cli.NewExitError(err, 1)
+	}
+	if c.IsSet("description") {
+		newSecret.Description = c.String("description")
+	}
+	if c.IsSet("owner") {
+		newSecret.Owner = c.String("owner")
+	}
+	newSecret.SetTags(tags)
+	if c.IsSet("expires") {
+		newSecret.Expires = nil
+		if expires := c.String("expires"); expires != "" {
+			when, err := model.ParseExpiry(expires, time.Now())
+			if err != nil {
+				return cli.NewExitError(err, 1)
+			}
+			newSecret.Expires = &when
+		}
+	}
+	if c.IsSet("rotate-every") {
+		err = newSecret.SetRotateEvery(c.String("rotate-every"))
+		if err != nil {
+			return cli.NewExitError(err, 1)
+		}
+	}
+	err = save(secretsFile, 8)
+	if err != nil {
+		return err
+	}
+	if added {
 		fmt.Println(aurora.Green("added secret"))
 	} else {
 		fmt.Println(aurora.Green("replaced secret"))
 	}
+	if value.publicKey != nil {
+		fmt.Println("Public key:")
+		fmt.Print(string(value.publicKey))
+	}
 	return nil
 }
 
 // List all the secrets.
 func List(c *cli.Context) error {
-	_, _, _, secretsFile, err := check1or2Args(c, "", "")
+	_, _, secretsFile, err := check1or2Args(c, "", "", sharedLock)
 	if err != nil {
 		return cli.NewExitError(err, 1)
 	}
+	defer secretsFile.Close()
 	if len(secretsFile.Secrets) == 0 {
 		fmt.Println(aurora.White("empty"))
 		return nil
 	}
+	tags, err := model.ParseTags(c.StringSlice("tag"))
+	if err != nil {
+		return cli.NewExitError(err, 1)
+	}
+	dueWithin, err := model.ParseInterval(c.String("due-within"))
+	if err != nil {
+		return cli.NewExitError(err, 1)
+	}
+	filter := &model.SecretFilter{Owner: c.String("owner"), Tags: tags, Search: c.String("search")}
+	now := time.Now()
 	for _, secret := range secretsFile.Secrets {
+		if !filter.Matches(secret) {
+			continue
+		}
 		accessList := "accessible by [" + strings.Join(secret.Access, ",") + "]"
-		truncatedSecret := "****" + string(secret.Secret[len(secret.Secret)-4:])
-		fmt.Printf("%s: %s %s\n", aurora.White(secret.Name), aurora.Green(truncatedSecret), aurora.Blue(accessList))
+		truncatedSecret := "****"
+		// short values are masked completely, their last characters are most of them
+		if len(secret.Secret) > 4 {
+			truncatedSecret += string(secret.Secret[len(secret.Secret)-4:])
+		}
+		fmt.Printf("%s: %s %s%s\n", aurora.White(secret.Name), aurora.Green(truncatedSecret), aurora.Blue(accessList), expiryNote(secret, now, dueWithin))
+		printMetadata(secret)
+	}
+	return nil
+}
+
+// expiryNote flags a secret that is overdue or due soon
+func expiryNote(secret *model.Secret, now time.Time, dueWithin time.Duration) string {
+	switch secret.ExpiryStatus(now, dueWithin) {
+	case model.Overdue:
+		if secret.Expired(now) {
+			return " " + aurora.Red("expired since "+formatTime(secret.Expires)).String()
+		}
+		return " " + aurora.Red("rotation overdue since "+formatTime(secret.Deadline())).String()
+	case model.DueSoon:
+		return " " + aurora.Yellow("due "+formatTime(secret.Deadline())).String()
+	}
+	return ""
+}
+
+// CheckExpiry fail when any secret is past its expiry or rotation deadline
+func CheckExpiry(c *cli.Context) error {
+	_, _, secretsFile, err := check1or2Args(c, "", "", sharedLock)
+	if err != nil {
+		return cli.NewExitError(err, 1)
+	}
+	defer secretsFile.Close()
+	dueWithin, err := model.ParseInterval(c.String("due-within"))
+	if err != nil {
+		return cli.NewExitError(err, 1)
+	}
+	now := time.Now()
+	overdue := 0
+	for _, secret := range secretsFile.Secrets {
+		status := secret.ExpiryStatus(now, dueWithin)
+		if status == model.Overdue {
+			overdue++
+		}
+		if status == model.Overdue || status == model.DueSoon {
+			fmt.Printf("%s:%s\n", aurora.White(secret.Name), expiryNote(secret, now, dueWithin))
+		}
+	}
+	if overdue > 0 {
+		return cli.NewExitError(fmt.Sprintf("%d secrets overdue", overdue), 1)
 	}
+	fmt.Println(aurora.Green("ok"))
 	return nil
 }
 
+func printMetadata(secret *model.Secret) {
+	if secret.Description != "" {
+		fmt.Printf("    %s\n", secret.Description)
+	}
+	details := []string{}
+	if secret.Owner != "" {
+		details = append(details, "owner "+secret.Owner)
+	}
+	if len(secret.Tags) > 0 {
+		details = append(details, "tags "+secret.FormatTags())
+	}
+	if secret.Created != nil {
+		details = append(details, "created "+formatTime(secret.Created))
+	}
+	if secret.Updated != nil {
+		details = append(details, "updated "+formatTime(secret.Updated))
+	}
+	if secret.Expires != nil {
+		details = append(details, "expires "+formatTime(secret.Expires))
+	}
+	if secret.RotateEvery != "" {
+		details = append(details, "rotate every "+secret.RotateEvery)
+	}
+	if len(details) > 0 {
+		fmt.Printf("    %s\n", aurora.Gray(12, strings.Join(details, ", ")))
+	}
+}
+
 // Get a secret value
 func Get(c *cli.Context) error {
-	name, _, _, secretsFile, err := check1or2Args(c, "secret name", "")
+	if c.String("as-service") != "" {
+		return getAsService(c)
+	}
+	name, _, secretsFile, err := check1or2Args(c, "secret name", "", sharedLock)
 	if err != nil {
 		return cli.NewExitError(err, 1)
 	}
+	defer secretsFile.Close()
 
 	if len(secretsFile.Secrets) == 0 {
 		return cli.NewExitError("no Secrets", 1)
 	}
+	if c.IsSet("version") {
+		value, err := secretsFile.SecretVersionValue(name, c.Int("version"))
+		if err != nil {
+			return cli.NewExitError(err, 1)
+		}
+		fmt.Println(string(value))
+		return nil
+	}
 	for _, secret := range secretsFile.Secrets {
 		if secret.Name == name {
 			fmt.Println(string(secret.Secret))
 			return nil
 		}
 	}
-	return cli.NewExitError("colud not find secret: "+name, 1)
+	return cli.NewExitError("could not find secret: "+name, 1)
+}
+
+// getAsService get a secret the way the service sees it, with its token
+func getAsService(c *cli.Context) error {
+	name := strings.TrimSpace(c.Args().Get(0))
+	if name == "" {
+		return cli.NewExitError("must specify secret name as first argument", 1)
+	}
+	if c.IsSet("version") {
+		return cli.NewExitError("services only see the current version", 1)
+	}
+	secretsFile, err := serviceSecrets(c)
+	if err != nil {
+		return cli.NewExitError(err, 1)
+	}
+	i := secretsFile.IndexOfSecret(name)
+	if i == -1 {
+		file, err := secretsFileName(c)
+		if err != nil {
+			return cli.NewExitError(err, 1)
+		}
+		if expired, err := model.ExpiredForService(file, c.String("as-service"), name); err == nil && expired {
+			return cli.NewExitError("secret "+name+" expired", 1)
+		}
+		return cli.NewExitError(fmt.Sprintf("service %s can't read secret: %s", c.String("as-service"), name), 1)
+	}
+	fmt.Println(string(secretsFile.Secrets[i].Secret))
+	return nil
+}
+
+// serviceSecrets the secrets the --as-service service can read, unlocked
+// with its token from SECRETS_SERVICE_TOKEN or asked for, not the passphrase
+func serviceSecrets(c *cli.Context) (*model.SecretsFile, error) {
+	service := c.String("as-service")
+	token := strings.TrimSpace(os.Getenv(serviceTokenEnv))
+	if token == "" {
+		typed, err := prompt("token for " + service)
+		if err != nil {
+			return nil, fmt.Errorf("set %s or type the token: %v", serviceTokenEnv, err)
+		}
+		token = strings.TrimSpace(string(typed))
+	}
+	file, err := secretsFileName(c)
+	if err != nil {
+		return nil, err
+	}
+	secrets, err := model.LoadServiceSecrets(file, service, []byte(token))
+	if err != nil {
+		return nil, err
+	}
+	return &model.SecretsFile{Secrets: secrets}, nil
+}
+
+// History list the versions of a secret
+func History(c *cli.Context) error {
+	name, _, secretsFile, err := check1or2Args(c, "secret name", "", sharedLock)
+	if err != nil {
+		return cli.NewExitError(err, 1)
+	}
+	defer secretsFile.Close()
+	i := secretsFile.IndexOfSecret(name)
+	if i == -1 {
+		return cli.NewExitError("could not find secret: "+name, 1)
+	}
+	secret := secretsFile.Secrets[i]
+	fmt.Printf("%s %s %s\n", aurora.White(fmt.Sprintf("v%d", secret.CurrentVersion())), formatTime(secret.VersionCreated), aurora.Green("(current)"))
+	for j := len(secret.History) - 1; j >= 0; j-- {
+		previous := secret.History[j]
+		fmt.Printf("%s %s\n", aurora.White(fmt.Sprintf("v%d", previous.Version)), formatTime(previous.Created))
+	}
+	return nil
+}
+
+func formatTime(created *time.Time) string {
+	if created == nil {
+		return "unknown"
+	}
+	return created.Local().Format(time.RFC3339)
+}
+
+// Rollback make a previous version of a secret the current value again
+func Rollback(c *cli.Context) error {
+	name, version, secretsFile, err := check1or2Args(c, "secret name", "version", exclusiveLock)
+	if err != nil {
+		return cli.NewExitError(err, 1)
+	}
+	defer secretsFile.Close()
+	number, err := strconv.Atoi(strings.TrimPrefix(version, "v"))
+	if err != nil {
+		return cli.NewExitError("version must be a number: "+version, 1)
+	}
+	secret, err := secretsFile.Rollback(name, number)
+	if err != nil {
+		return cli.NewExitError(err, 1)
+	}
+	err = save(secretsFile, 1)
+	if err != nil {
+		return err
+	}
+	fmt.Printf(aurora.Green("rolled %s back to version %d, now version %d\n").String(), aurora.White(name), aurora.White(number), aurora.White(secret.CurrentVersion()))
+	return nil
+}
+
+// Retention set how many previous versions of each secret the file keeps
+func Retention(c *cli.Context) error {
+	versions, _, secretsFile, err := check1or2Args(c, "number of versions", "", exclusiveLock)
+	if err != nil {
+		return cli.NewExitError(err, 1)
+	}
+	defer secretsFile.Close()
+	number, err := strconv.Atoi(versions)
+	if err != nil {
+		return cli.NewExitError("number of versions must be a number: "+versions, 1)
+	}
+	err = secretsFile.SetRetention(number)
+	if err != nil {
+		return cli.NewExitError(err, 1)
+	}
+	err = save(secretsFile, 1)
+	if err != nil {
+		return err
+	}
+	fmt.Printf(aurora.Green("keeping %d previous versions of each secret\n").String(), aurora.White(number))
+	return nil
 }
 
 // GetAccessToken the token for a specified service
 func GetAccessToken(c *cli.Context) error {
-	serviceName, _, _, secretsFile, err := check1or2Args(c, "service name", "")
+	serviceName, _, secretsFile, err := check1or2Args(c, "service name", "", sharedLock)
 	if err != nil {
 		return cli.NewExitError(err, 1)
 	}
+	defer secretsFile.Close()
 
 	if len(secretsFile.Secrets) == 0 {
 		return cli.NewExitError("no Secrets", 1)
 	}
 	if access, ok := secretsFile.HasService(serviceName); ok {
+		if access.Hashed() {
+			return cli.NewExitError("the token for "+serviceName+" is hashed and can't be shown, use rotate-token to issue a new one", 1)
+		}
 		fmt.Println(string(access.Secret))
 		return nil
 	}
-	return cli.NewExitError("colud not find service: "+serviceName, 1)
+	return cli.NewExitError("could not find service: "+serviceName, 1)
 }
 
 func generateRandomHexBytes(n int) ([]byte, error) {
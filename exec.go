@@ -0,0 +1,167 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"os/signal"
+	"regexp"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/codeallthethingz/secrets/model"
+	"github.com/logrusorgru/aurora"
+	"github.com/urfave/cli"
+)
+
+var invalidEnvCharacters = regexp.MustCompile("[^A-Z0-9_]")
+
+// envName turns a secret name into a variable name, mongo-token is MONGO_TOKEN
+func envName(name string) string {
+	return invalidEnvCharacters.ReplaceAllString(strings.ToUpper(name), "_")
+}
+
+// secretEnv works out which variable each secret goes in. --map takes
+// VAR=secret pairs, --prefix takes a secret name prefix, optionally with a
+// variable prefix as VAR_PREFIX=secret-prefix, and maps every secret whose
+// name starts with it.
+func secretEnv(secretsFile *model.SecretsFile, maps []string, prefixes []string) (map[string]*model.Secret, error) {
+	env := map[string]*model.Secret{}
+	add := func(variable string, secret *model.Secret) error {
+		if variable == "" || invalidEnvCharacters.MatchString(strings.ToUpper(variable)) {
+			return fmt.Errorf("invalid environment variable name: %s", variable)
+		}
+		if existing, ok := env[variable]; ok && existing != secret {
+			return fmt.Errorf("%s is mapped to both %s and %s", variable, existing.Name, secret.Name)
+		}
+		env[variable] = secret
+		return nil
+	}
+	for _, pairs := range maps {
+		for _, pair := range strings.Split(pairs, ",") {
+			parts := strings.SplitN(pair, "=", 2)
+			if len(parts) != 2 {
+				return nil, fmt.Errorf("--map takes VAR=secret pairs: %s", pair)
+			}
+			variable, name := strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1])
+			i := secretsFile.IndexOfSecret(name)
+			if i == -1 {
+				return nil, fmt.Errorf("could not find secret: %s", name)
+			}
+			if err := add(variable, secretsFile.Secrets[i]); err != nil {
+				return nil, err
+			}
+		}
+	}
+	for _, prefix := range prefixes {
+		variablePrefix, namePrefix := "", prefix
+		if parts := strings.SplitN(prefix, "=", 2); len(parts) == 2 {
+			variablePrefix, namePrefix = parts[0], parts[1]
+		}
+		matched := false
+		for _, secret := range secretsFile.Secrets {
+			if !strings.HasPrefix(secret.Name, namePrefix) || secret.Name == namePrefix {
+				continue
+			}
+			matched = true
+			if err := add(variablePrefix+envName(strings.TrimPrefix(secret.Name, namePrefix)), secret); err != nil {
+				return nil, err
+			}
+		}
+		if !matched {
+			return nil, fmt.Errorf("no secrets start with %s", namePrefix)
+		}
+	}
+	if len(env) == 0 {
+		return nil, fmt.Errorf("must specify the secrets to pass with --map or --prefix")
+	}
+	return env, nil
+}
+
+// Exec run a command with secrets in its environment, the secrets file is
+// closed before the command starts. With --as-service only the secrets the
+// service can read are available.
+func Exec(c *cli.Context) error {
+	if len(c.Args()) == 0 {
+		return cli.NewExitError("must specify the command to run after --", 1)
+	}
+	var secretsFile *model.SecretsFile
+	var err error
+	if c.String("as-service") != "" {
+		secretsFile, err = serviceSecrets(c)
+	} else {
+		_, _, secretsFile, err = check1or2Args(c, "", "", sharedLock)
+	}
+	if err != nil {
+		return cli.NewExitError(err, 1)
+	}
+	mapped, err := secretEnv(secretsFile, c.StringSlice("map"), c.StringSlice("prefix"))
+	secretsFile.Close()
+	if err != nil {
+		return cli.NewExitError(err, 1)
+	}
+	env := os.Environ()
+	if c.Bool("clear-env") {
+		env = []string{}
+	}
+	variables := []string{}
+	for variable := range mapped {
+		variables = append(variables, variable)
+	}
+	sort.Strings(variables)
+	for _, variable := range variables {
+		secret := mapped[variable]
+		if secret.Expired(time.Now()) {
+			fmt.Fprintln(os.Stderr, aurora.Yellow(fmt.Sprintf("%s is past its expiry", secret.Name)))
+		} else if secret.RotationDue(time.Now()) {
+			fmt.Fprintln(os.Stderr, aurora.Yellow(fmt.Sprintf("%s is due to be rotated", secret.Name)))
+		}
+		env = append(env, variable+"="+string(secret.Secret))
+	}
+	return run(c.Args(), env)
+}
+
+// run starts the command, passes on the signals it gets to it, other than
+// the ones the terminal sent it as well, and exits with the command's exit code
+func run(args []string, env []string) error {
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Env = env
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, forwardedSignals...)
+	defer signal.Stop(signals)
+	if err := cmd.Start(); err != nil {
+		return cli.NewExitError(err, 127)
+	}
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		for {
+			select {
+			case sig := <-signals:
+				if !deliveredByTerminal(sig) {
+					cmd.Process.Signal(sig)
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+	err := cmd.Wait()
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		code := exitErr.ExitCode()
+		if status, ok := exitErr.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+			// the shell convention for a command killed by a signal
+			code = 128 + int(status.Signal())
+		}
+		return cli.NewExitError("", code)
+	}
+	if err != nil {
+		return cli.NewExitError(err, 1)
+	}
+	return nil
+}
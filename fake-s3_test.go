@@ -0,0 +1,131 @@
+package main
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const testAccessKey = "testaccesskey"
+
+type fakeS3Version struct {
+	id       string
+	data     []byte
+	etag     string
+	modified time.Time
+}
+
+// fakeS3 an in-process stand-in for a versioned S3 bucket with conditional writes
+type fakeS3 struct {
+	mutex   sync.Mutex
+	objects map[string][]*fakeS3Version
+	next    int
+}
+
+// startFakeS3 serves a fake bucket and points the s3 store's credentials at it,
+// returns the s3:// location of key
+func startFakeS3(t *testing.T, key string) string {
+	fake := &fakeS3{objects: map[string][]*fakeS3Version{}}
+	server := httptest.NewServer(fake)
+	t.Cleanup(server.Close)
+	t.Setenv("AWS_ACCESS_KEY_ID", testAccessKey)
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "testsecretkey")
+	return "s3://testbucket/" + key + "?endpoint=" + server.URL
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if !strings.Contains(r.Header.Get("Authorization"), "Credential="+testAccessKey+"/") {
+		f.error(w, http.StatusForbidden, "AccessDenied")
+		return
+	}
+	path := strings.TrimPrefix(r.URL.Path, "/testbucket/")
+	if path == r.URL.Path {
+		f.error(w, http.StatusNotFound, "NoSuchBucket")
+		return
+	}
+	if _, ok := r.URL.Query()["versions"]; ok && r.Method == "GET" {
+		f.listVersions(w, r.URL.Query().Get("prefix"))
+		return
+	}
+	versions := f.objects[path]
+	var latest *fakeS3Version
+	if len(versions) > 0 {
+		latest = versions[len(versions)-1]
+	}
+	switch r.Method {
+	case "GET":
+		if latest == nil {
+			f.error(w, http.StatusNotFound, "NoSuchKey")
+			return
+		}
+		w.Header().Set("ETag", latest.etag)
+		w.Write(latest.data)
+	case "PUT":
+		if r.Header.Get("If-None-Match") == "*" && latest != nil {
+			f.error(w, http.StatusPreconditionFailed, "PreconditionFailed")
+			return
+		}
+		if match := r.Header.Get("If-Match"); match != "" && (latest == nil || latest.etag != match) {
+			f.error(w, http.StatusPreconditionFailed, "PreconditionFailed")
+			return
+		}
+		data, _ := ioutil.ReadAll(r.Body)
+		hash := md5.Sum(data)
+		f.next++
+		version := &fakeS3Version{
+			id:       fmt.Sprintf("version-%d", f.next),
+			data:     data,
+			etag:     `"` + hex.EncodeToString(hash[:]) + `"`,
+			modified: time.Now().UTC().Add(time.Duration(f.next) * time.Second),
+		}
+		f.objects[path] = append(versions, version)
+		w.Header().Set("ETag", version.etag)
+		w.Header().Set("X-Amz-Version-Id", version.id)
+	default:
+		f.error(w, http.StatusMethodNotAllowed, "MethodNotAllowed")
+	}
+}
+
+type fakeS3ListVersions struct {
+	XMLName  xml.Name `xml:"ListVersionsResult"`
+	Versions []struct {
+		Key          string
+		VersionID    string `xml:"VersionId"`
+		IsLatest     bool
+		LastModified string
+	} `xml:"Version"`
+}
+
+func (f *fakeS3) listVersions(w http.ResponseWriter, prefix string) {
+	result := fakeS3ListVersions{}
+	for key, versions := range f.objects {
+		if !strings.HasPrefix(key, prefix) {
+			continue
+		}
+		for i, version := range versions {
+			result.Versions = append(result.Versions, struct {
+				Key          string
+				VersionID    string `xml:"VersionId"`
+				IsLatest     bool
+				LastModified string
+			}{key, version.id, i == len(versions)-1, version.modified.Format(time.RFC3339)})
+		}
+	}
+	data, _ := xml.Marshal(result)
+	w.Write(data)
+}
+
+func (f *fakeS3) error(w http.ResponseWriter, status int, code string) {
+	w.WriteHeader(status)
+	fmt.Fprintf(w, "<Error><Code>%s</Code><Message>%s</Message></Error>", code, http.StatusText(status))
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"sort"
+	"strings"
+)
+
+const (
+	defaultPasswordLength = 32
+	defaultRandomBytes    = 32
+	defaultRSABits        = 3072
+	minimumRSABits        = 2048
+	defaultCurve          = "p256"
+	defaultPasswordPolicy = "lower,upper,digit,symbol"
+)
+
+// passwordClasses the character classes a password policy can require
+var passwordClasses = map[string]string{
+	"lower":  "abcdefghijklmnopqrstuvwxyz",
+	"upper":  "ABCDEFGHIJKLMNOPQRSTUVWXYZ",
+	"digit":  "0123456789",
+	"symbol": "!#%+,-./:=?@^_~",
+}
+
+var curves = map[string]elliptic.Curve{
+	"p256": elliptic.P256(),
+	"p384": elliptic.P384(),
+	"p521": elliptic.P521(),
+}
+
+// generatorOptions how a generator shapes the value
+type generatorOptions struct {
+	length  int
+	classes string
+	bits    int
+	curve   string
+}
+
+// generated a generated secret value, and the public half of a key pair
+type generated struct {
+	value     []byte
+	publicKey []byte
+}
+
+type generator func(options generatorOptions) (*generated, error)
+
+var generators = map[string]generator{
+	"password": generatePassword,
+	"hex":      generateHex,
+	"base64":   generateBase64,
+	"uuid":     generateUUID,
+	"ed25519":  generateEd25519,
+	"rsa":      generateRSA,
+	"ecdsa":    generateECDSA,
+}
+
+func generatorNames() string {
+	names := []string{}
+	for name := range generators {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+func generate(kind string, options generatorOptions) (*generated, error) {
+	generator, ok := generators[kind]
+	if !ok {
+		return nil, fmt.Errorf("unknown generator %s, use one of %s", kind, generatorNames())
+	}
+	return generator(options)
+}
+
+// randomIndex a uniformly random number below n
+func randomIndex(n int) (int, error) {
+	i, err := rand.Int(rand.Reader, big.NewInt(int64(n)))
+	if err != nil {
+		return 0, err
+	}
+	return int(i.Int64()), nil
+}
+
+// generatePassword picks characters from the classes in the policy, with at
+// least one from each class
+func generatePassword(options generatorOptions) (*generated, error) {
+	length := options.length
+	if length == 0 {
+		length = defaultPasswordLength
+	}
+	policy := options.classes
+	if policy == "" {
+		policy = defaultPasswordPolicy
+	}
+	alphabet := ""
+	password := []byte{}
+	// a class named twice would be twice as likely in the alphabet
+	seen := map[string]bool{}
+	for _, class := range strings.Split(policy, ",") {
+		class = strings.TrimSpace(class)
+		characters, ok := passwordClasses[class]
+		if !ok {
+			return nil, fmt.Errorf("unknown character class %s, use lower, upper, digit or symbol", class)
+		}
+		if seen[class] {
+			return nil, fmt.Errorf("character class %s is named more than once", class)
+		}
+		seen[class] = true
+		i, err := randomIndex(len(characters))
+		if err != nil {
+			return nil, err
+		}
+		password = append(password, characters[i])
+		alphabet += characters
+	}
+	if length < len(password) {
+		return nil, fmt.Errorf("a password needs at least %d characters to have one of each class", len(password))
+	}
+	for len(password) < length {
+		i, err := randomIndex(len(alphabet))
+		if err != nil {
+			return nil, err
+		}
+		password = append(password, alphabet[i])
+	}
+	// the required characters go anywhere, not just at the start
+	for i := len(password) - 1; i > 0; i-- {
+		j, err := randomIndex(i + 1)
+		if err != nil {
+			return nil, err
+		}
+		password[i], password[j] = password[j], password[i]
+	}
+	return &generated{value: password}, nil
+}
+
+// byteLength how many random bytes hex and base64 values are made from
+func byteLength(options generatorOptions) (int, error) {
+	if options.length < 0 {
+		return 0, fmt.Errorf("length can't be negative")
+	}
+	if options.length == 0 {
+		return defaultRandomBytes, nil
+	}
+	return options.length, nil
+}
+
+func generateHex(options generatorOptions) (*generated, error) {
+	length, err := byteLength(options)
+	if err != nil {
+		return nil, err
+	}
+	value, err := generateRandomHexBytes(length)
+	if err != nil {
+		return nil, err
+	}
+	return &generated{value: value}, nil
+}
+
+func generateBase64(options generatorOptions) (*generated, error) {
+	length, err := byteLength(options)
+	if err != nil {
+		return nil, err
+	}
+	b := make([]byte, length)
+	if _, err := rand.Read(b); err != nil {
+		return nil, err
+	}
+	return &generated{value: []byte(base64.StdEncoding.EncodeToString(b))}, nil
+}
+
+// generateUUID a random, version 4, UUID
+func generateUUID(options generatorOptions) (*generated, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return nil, err
+	}
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return &generated{value: []byte(fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:]))}, nil
+}
+
+// keyPair the private key as PKCS #8 PEM, the value of the secret, and the
+// public key as PKIX PEM
+func keyPair(private interface{}, public interface{}) (*generated, error) {
+	privateDER, err := x509.MarshalPKCS8PrivateKey(private)
+	if err != nil {
+		return nil, err
+	}
+	publicDER, err := x509.MarshalPKIXPublicKey(public)
+	if err != nil {
+		return nil, err
+	}
+	return &generated{
+		value:     pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: privateDER}),
+		publicKey: pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: publicDER}),
+	}, nil
+}
+
+func generateEd25519(options generatorOptions) (*generated, error) {
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	return keyPair(private, public)
+}
+
+func generateRSA(options generatorOptions) (*generated, error) {
+	bits := options.bits
+	if bits == 0 {
+		bits = defaultRSABits
+	}
+	if bits < minimumRSABits {
+		return nil, fmt.Errorf("rsa keys need at least %d bits", minimumRSABits)
+	}
+	private, err := rsa.GenerateKey(rand.Reader, bits)
+	if err != nil {
+		return nil, err
+	}
+	return keyPair(private, &private.PublicKey)
+}
+
+func generateECDSA(options generatorOptions) (*generated, error) {
+	name := options.curve
+	if name == "" {
+		name = defaultCurve
+	}
+	curve, ok := curves[strings.ToLower(name)]
+	if !ok {
+		return nil, fmt.Errorf("unknown curve %s, use p256, p384 or p521", name)
+	}
+	private, err := ecdsa.GenerateKey(curve, rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	return keyPair(private, &private.PublicKey)
+}
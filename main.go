@@ -4,6 +4,7 @@ import (
 	"log"
 	"os"
 
+	"github.com/codeallthethingz/secrets/model"
 	"github.com/urfave/cli"
 )
 
@@ -27,12 +28,34 @@ func CreateApp() *cli.App {
 	app.Flags = []cli.Flag{
 		cli.StringFlag{
 			Name:  "passphrase, p",
-			Usage: "the phrase to encrypt and decrypt the vault",
+			Usage: "the phrase to encrypt and decrypt the vault, otherwise read from SECRETS_PASSPHRASE, --passphrase-file, --passphrase-command or asked for",
+		},
+		cli.StringFlag{
+			Name:  "passphrase-file",
+			Usage: "file to read the passphrase from",
+		},
+		cli.StringFlag{
+			Name:  "passphrase-command",
+			Usage: "command whose output is the passphrase, such as \"pass show secrets\"",
+		},
+		cli.StringFlag{
+			Name:  "identity, i",
+			Usage: "private key file to unlock the vault with instead of a passphrase",
 		},
 		cli.StringFlag{
 			Name:  "secrets-file, f",
 			Value: "secrets.json",
-			Usage: "change the file that is being used to store secrets",
+			Usage: "where the secrets are stored, a path or a file://, s3://, sqlite:// or dir:// URL",
+		},
+		cli.StringFlag{
+			Name:  "on-conflict",
+			Value: "fail",
+			Usage: "when someone else changed the secrets file during a command, fail or rebase (re-apply the command to the latest revision)",
+		},
+		cli.DurationFlag{
+			Name:  "lock-timeout",
+			Value: model.DefaultLockTimeout,
+			Usage: "how long to wait for another secrets command to release the secrets file",
 		},
 	}
 	app.Commands = []cli.Command{
@@ -40,31 +63,112 @@ func CreateApp() *cli.App {
 			Name:      "set",
 			Usage:     "set a secret to the credential file, overwrites if exists but keeps access list",
 			Action:    Set,
-			ArgsUsage: "`secret name` `secret value`",
+			ArgsUsage: "`secret name` [`secret value` | -]",
+			Flags: append(append(secretFlags(), cli.StringFlag{
+				Name:  "generate",
+				Usage: "generate the value instead of giving it, one of " + generatorNames(),
+			}, cli.StringFlag{
+				Name:  "from-file",
+				Usage: "read the value from a file, as raw bytes",
+			}), generatorFlags()...),
+		},
+		{
+			Name:      "generate",
+			Usage:     "set a secret to a generated value, so it never passes through the shell",
+			Action:    Generate,
+			ArgsUsage: "`secret name`",
+			Flags: append(append(secretFlags(), cli.StringFlag{
+				Name:  "type",
+				Value: "password",
+				Usage: "what to generate, one of " + generatorNames(),
+			}), generatorFlags()...),
 		},
 		{
 			Name:      "get",
 			Usage:     "get a secret out of the secrets file",
 			Action:    Get,
 			ArgsUsage: "`secret name`",
+			Flags: []cli.Flag{
+				cli.IntFlag{
+					Name:  "version",
+					Usage: "get a previous version of the secret, see history",
+				},
+				asServiceFlag(),
+			},
+		},
+		{
+			Name:      "history",
+			Usage:     "list the versions of a secret",
+			Action:    History,
+			ArgsUsage: "`secret name`",
+		},
+		{
+			Name:      "rollback",
+			Usage:     "make a previous version of a secret the current value again",
+			Action:    rebaseOnConflict(Rollback),
+			ArgsUsage: "`secret name` `version`",
+		},
+		{
+			Name:      "retention",
+			Usage:     "set how many previous versions of each secret are kept (default: 10)",
+			Action:    rebaseOnConflict(Retention),
+			ArgsUsage: "`number of versions`",
 		},
 		{
 			Name:      "list",
 			Usage:     "list all the secrets in the credentials file",
 			Action:    List,
 			ArgsUsage: " ",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "owner",
+					Usage: "only list the secrets with this owner",
+				},
+				cli.StringSliceFlag{
+					Name:  "tag",
+					Usage: "only list the secrets tagged key=value, can be repeated",
+				},
+				cli.StringFlag{
+					Name:  "search",
+					Usage: "only list the secrets with this text in their name or description",
+				},
+				cli.StringFlag{
+					Name:  "due-within",
+					Value: model.DefaultDueWithin,
+					Usage: "flag secrets whose expiry or rotation deadline is this close",
+				},
+			},
+		},
+		{
+			Name:      "check-expiry",
+			Usage:     "fail when any secret is past its expiry or rotation deadline, warn about those that are due soon",
+			Action:    CheckExpiry,
+			ArgsUsage: " ",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "due-within",
+					Value: model.DefaultDueWithin,
+					Usage: "warn about secrets whose deadline is this close",
+				},
+			},
 		},
 		{
 			Name:      "remove",
 			Usage:     "remove a secret from the credential file",
-			Action:    Remove,
+			Action:    rebaseOnConflict(Remove),
 			ArgsUsage: "`secret name`",
 		},
 		{
 			Name:      "add-access",
 			Usage:     "returns a new access token (or existing access token) with access to a comma separated secrets for a named service",
-			Action:    AddAccess,
+			Action:    rebaseOnConflict(AddAccess),
 			ArgsUsage: "`service name` `secret1,secret2,...`",
+			Flags: []cli.Flag{
+				cli.BoolFlag{
+					Name:  "hash-token",
+					Usage: "store only a hash of a new service's token, the token is shown once. Existing services are hashed with rotate-token --hash-token",
+				},
+			},
 		},
 		{
 			Name:      "get-access-token",
@@ -72,23 +176,178 @@ func CreateApp() *cli.App {
 			Action:    GetAccessToken,
 			ArgsUsage: "`service name`",
 		},
+		{
+			Name:      "rotate-token",
+			Usage:     "issue a new access token for a service, the old token stops working",
+			Action:    rebaseOnConflict(RotateToken),
+			ArgsUsage: "`service name`",
+			Flags: []cli.Flag{
+				cli.BoolFlag{
+					Name:  "hash-token",
+					Usage: "store only a hash of the new token, hashed services always stay hashed",
+				},
+			},
+		},
 		{
 			Name:      "remove-access",
 			Usage:     "remove access to the a comma separated list of secrets",
-			Action:    RemoveAccess,
+			Action:    rebaseOnConflict(RemoveAccess),
 			ArgsUsage: "`service name` `secret1,secret2,...`",
 		},
 		{
 			Name:      "revoke-service",
 			Usage:     "remove all access for a service and delete the service access token",
-			Action:    RevokeService,
+			Action:    rebaseOnConflict(RevokeService),
 			ArgsUsage: "`service name`",
 		},
 		{
 			Name:      "change-passphrase",
 			Usage:     "change the passphrase to a new passphrase",
 			Action:    Passphrase,
-			ArgsUsage: "`new passphrase`",
+			ArgsUsage: "[`new passphrase`]",
+			Flags:     newPassphraseFlags(),
+		},
+		{
+			Name:  "slot",
+			Usage: "manage the key slots, each slot unlocks the secrets file with its own passphrase",
+			Subcommands: []cli.Command{
+				{
+					Name:      "add",
+					Usage:     "add a key slot that unlocks the secrets file with another passphrase",
+					Action:    SlotAdd,
+					ArgsUsage: "`slot name` [`slot passphrase`]",
+					Flags:     newPassphraseFlags(),
+				},
+				{
+					Name:      "list",
+					Usage:     "list the key slots",
+					Action:    SlotList,
+					ArgsUsage: " ",
+				},
+				{
+					Name:      "remove",
+					Usage:     "remove a key slot, the last slot can't be removed",
+					Action:    rebaseOnConflict(SlotRemove),
+					ArgsUsage: "`slot name`",
+				},
+			},
+		},
+		{
+			Name:  "recipient",
+			Usage: "manage the public keys whose private keys (--identity) can unlock the secrets file",
+			Subcommands: []cli.Command{
+				{
+					Name:      "add",
+					Usage:     "add a recipient that can unlock the secrets file with their identity",
+					Action:    rebaseOnConflict(RecipientAdd),
+					ArgsUsage: "`recipient name` `public key`",
+				},
+				{
+					Name:      "list",
+					Usage:     "list the recipients and their public keys",
+					Action:    RecipientList,
+					ArgsUsage: " ",
+				},
+				{
+					Name:      "remove",
+					Usage:     "remove a recipient",
+					Action:    rebaseOnConflict(RecipientRemove),
+					ArgsUsage: "`recipient name`",
+				},
+				{
+					Name:      "keygen",
+					Usage:     "generate a new identity file and print its public key, does not need the passphrase",
+					Action:    RecipientKeygen,
+					ArgsUsage: "`identity file`",
+				},
+			},
+		},
+		{
+			Name:      "exec",
+			Usage:     "run a command with secrets in its environment, such as exec --map MONGO_TOKEN=mongo-token -- ./server",
+			Action:    Exec,
+			ArgsUsage: "-- `command` [`arguments`...]",
+			Flags: []cli.Flag{
+				cli.StringSliceFlag{
+					Name:  "map",
+					Usage: "comma separated VAR=secret pairs, can be repeated",
+				},
+				cli.StringSliceFlag{
+					Name:  "prefix",
+					Usage: "pass every secret whose name starts with the prefix, mongo- passes mongo-token as TOKEN and MONGO_=mongo- as MONGO_TOKEN, can be repeated",
+				},
+				cli.BoolFlag{
+					Name:  "clear-env",
+					Usage: "start the command with an empty environment, holding only the selected secrets",
+				},
+				asServiceFlag(),
+			},
+		},
+		{
+			Name:      "agent",
+			Usage:     "hold the keys of unlocked secrets files in memory, so commands don't need the passphrase",
+			Action:    Agent,
+			ArgsUsage: " ",
+			Flags: []cli.Flag{
+				cli.DurationFlag{
+					Name:  "idle-timeout",
+					Value: model.DefaultAgentIdleTimeout,
+					Usage: "forget the key of a file no command used for this long",
+				},
+			},
+		},
+		{
+			Name:      "unlock",
+			Usage:     "hand the key of the secrets file to the agent",
+			Action:    Unlock,
+			ArgsUsage: " ",
+		},
+		{
+			Name:      "lock",
+			Usage:     "make the agent forget the key of the secrets file",
+			Action:    Lock,
+			ArgsUsage: " ",
+			Flags: []cli.Flag{
+				cli.BoolFlag{
+					Name:  "all",
+					Usage: "forget the keys of every file",
+				},
+			},
+		},
+		{
+			Name:      "verify",
+			Usage:     "check that no secret, access list or service was modified outside of this tool",
+			Action:    Verify,
+			ArgsUsage: " ",
+		},
+		{
+			Name:      "versions",
+			Usage:     "list the versions of the secrets file kept by its store, does not need the passphrase",
+			Action:    Versions,
+			ArgsUsage: " ",
+		},
+		{
+			Name:      "convert",
+			Usage:     "copy the secrets file into another store, such as from secrets.json to sqlite://secrets.db, does not need the passphrase",
+			Action:    Convert,
+			ArgsUsage: "`destination`",
+		},
+		{
+			Name:      "migrate",
+			Usage:     "convert the secrets file to another format version, does not need the passphrase",
+			Action:    Migrate,
+			ArgsUsage: " ",
+			Flags: []cli.Flag{
+				cli.IntFlag{
+					Name:  "to",
+					Value: model.CurrentVersion,
+					Usage: "the format version to migrate to",
+				},
+				cli.BoolFlag{
+					Name:  "dry-run",
+					Usage: "show the migration steps without changing the file",
+				},
+			},
 		},
 	}
 	app.Action = func(c *cli.Context) error {
@@ -100,3 +359,76 @@ func CreateApp() *cli.App {
 	}
 	return app
 }
+
+// secretFlags the flags that describe a secret being set
+func secretFlags() []cli.Flag {
+	return []cli.Flag{
+		cli.StringFlag{
+			Name:  "description",
+			Usage: "what the secret is for",
+		},
+		cli.StringFlag{
+			Name:  "owner",
+			Usage: "who looks after the secret",
+		},
+		cli.StringSliceFlag{
+			Name:  "tag",
+			Usage: "tag the secret with key=value, key= removes the tag, can be repeated",
+		},
+		cli.StringFlag{
+			Name:  "expires",
+			Usage: "when the secret expires, a date (2006-01-02), a time (RFC3339) or an interval from now (90d), empty removes it",
+		},
+		cli.StringFlag{
+			Name:  "rotate-every",
+			Usage: "how long each value is valid for, such as 90d, 2w or 36h, empty removes it",
+		},
+	}
+}
+
+// generatorFlags the flags that shape a generated value
+func generatorFlags() []cli.Flag {
+	return []cli.Flag{
+		cli.IntFlag{
+			Name:  "length",
+			Usage: "characters in a password (default 32), or random bytes for hex and base64 (default 32)",
+		},
+		cli.StringFlag{
+			Name:  "classes",
+			Usage: "character classes a password has at least one of (default \"" + defaultPasswordPolicy + "\")",
+		},
+		cli.IntFlag{
+			Name:  "bits",
+			Usage: "size of an rsa key (default 3072)",
+		},
+		cli.StringFlag{
+			Name:  "curve",
+			Usage: "curve of an ecdsa key, p256, p384 or p521 (default \"" + defaultCurve + "\")",
+		},
+	}
+}
+
+// newPassphraseFlags where change-passphrase and slot add read the new
+// passphrase from, so it doesn't have to be an argument that ends up in the
+// shell history and ps
+func newPassphraseFlags() []cli.Flag {
+	return []cli.Flag{
+		cli.StringFlag{
+			Name:  "new-passphrase-file",
+			Usage: "file to read the new passphrase from",
+		},
+		cli.StringFlag{
+			Name:  "new-passphrase-command",
+			Usage: "command whose output is the new passphrase, otherwise read from SECRETS_NEW_PASSPHRASE or asked for twice",
+		},
+	}
+}
+
+// asServiceFlag unlocks the secrets a service can read with its token, from
+// SECRETS_SERVICE_TOKEN or asked for, instead of the passphrase
+func asServiceFlag() cli.Flag {
+	return cli.StringFlag{
+		Name:  "as-service",
+		Usage: "only the secrets the service can read, unlocked with its token from SECRETS_SERVICE_TOKEN or asked for instead of the passphrase",
+	}
+}
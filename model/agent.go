@@ -0,0 +1,282 @@
+package model
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// DefaultAgentIdleTimeout how long the agent keeps a key no command asks for
+const DefaultAgentIdleTimeout = 15 * time.Minute
+
+// AgentSocketEnv the environment variable with the agent's socket, when it
+// isn't at the default location
+const AgentSocketEnv = "SECRETS_AGENT_SOCK"
+
+// agentDialTimeout commands carry on without the agent if it doesn't answer
+const agentDialTimeout = time.Second
+
+// AgentSocket where the agent listens, SECRETS_AGENT_SOCK or a socket in
+// XDG_RUNTIME_DIR. Empty when neither is set, the agent then listens in a
+// new private directory and prints where.
+func AgentSocket() string {
+	if socket := os.Getenv(AgentSocketEnv); socket != "" {
+		return socket
+	}
+	if runtimeDir := os.Getenv("XDG_RUNTIME_DIR"); runtimeDir != "" {
+		return filepath.Join(runtimeDir, "secrets-agent.sock")
+	}
+	return ""
+}
+
+type agentRequest struct {
+	Op   string `json:"op"`
+	File string `json:"file,omitempty"`
+	Key  []byte `json:"key,omitempty"`
+}
+
+type agentResponse struct {
+	Key     []byte `json:"key,omitempty"`
+	Dropped int    `json:"dropped,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
+
+// Agent holds the data keys of unlocked files in memory, each is dropped
+// once it goes unused for the idle timeout
+type Agent struct {
+	idleTimeout time.Duration
+	mutex       sync.Mutex
+	keys        map[string]*agentEntry
+}
+
+type agentEntry struct {
+	key   []byte
+	timer *time.Timer
+}
+
+// NewAgent an agent holding no keys
+func NewAgent(idleTimeout time.Duration) *Agent {
+	return &Agent{idleTimeout: idleTimeout, keys: map[string]*agentEntry{}}
+}
+
+// ListenAgent listens on the socket, which only the user can connect to, or
+// in a new private directory when socket is empty. The directory has to
+// belong to the user and be closed to everyone else. A socket left behind by
+// an agent that is no longer running is replaced.
+func ListenAgent(socket string) (net.Listener, error) {
+	if socket == "" {
+		dir, err := os.MkdirTemp("", "secrets-agent-")
+		if err != nil {
+			return nil, err
+		}
+		socket = filepath.Join(dir, "agent.sock")
+	}
+	if err := os.MkdirAll(filepath.Dir(socket), 0700); err != nil {
+		return nil, err
+	}
+	if err := checkPrivate(filepath.Dir(socket), true); err != nil {
+		return nil, err
+	}
+	if conn, err := net.DialTimeout("unix", socket, agentDialTimeout); err == nil {
+		conn.Close()
+		return nil, fmt.Errorf("an agent is already listening on %s", socket)
+	}
+	os.Remove(socket)
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(socket, 0600); err != nil {
+		listener.Close()
+		return nil, err
+	}
+	return listener, nil
+}
+
+// Serve answers requests until the listener is closed, then drops every key
+func (a *Agent) Serve(listener net.Listener) error {
+	defer a.drop("")
+	for {
+		conn, err := listener.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		go a.handle(conn)
+	}
+}
+
+func (a *Agent) handle(conn net.Conn) {
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(agentDialTimeout))
+	request := &agentRequest{}
+	response := &agentResponse{}
+	if err := json.NewDecoder(conn).Decode(request); err != nil {
+		response.Error = err.Error()
+	} else {
+		switch request.Op {
+		case "add":
+			a.add(request.File, request.Key)
+		case "get":
+			response.Key = a.get(request.File)
+		case "lock":
+			response.Dropped = a.drop(request.File)
+		default:
+			response.Error = fmt.Sprintf("unknown request: %s", request.Op)
+		}
+	}
+	json.NewEncoder(conn).Encode(response)
+}
+
+func (a *Agent) add(file string, key []byte) {
+	a.drop(file)
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	a.keys[file] = &agentEntry{
+		key:   key,
+		timer: time.AfterFunc(a.idleTimeout, func() { a.drop(file) }),
+	}
+}
+
+func (a *Agent) get(file string) []byte {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	entry, ok := a.keys[file]
+	if !ok {
+		return nil
+	}
+	entry.timer.Reset(a.idleTimeout)
+	// the entry can be dropped, and zeroed, before the key is sent
+	return append([]byte{}, entry.key...)
+}
+
+// drop forgets the key of the file, or every key when file is empty, and
+// returns how many were dropped
+func (a *Agent) drop(file string) int {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	dropped := 0
+	for name, entry := range a.keys {
+		if file != "" && name != file {
+			continue
+		}
+		entry.timer.Stop()
+		for i := range entry.key {
+			entry.key[i] = 0
+		}
+		delete(a.keys, name)
+		dropped++
+	}
+	return dropped
+}
+
+// callAgent sends the request to the agent, only once the socket and its
+// directory are known to be the user's own
+func callAgent(request *agentRequest) (*agentResponse, error) {
+	socket := AgentSocket()
+	if socket == "" {
+		return nil, fmt.Errorf("no agent, %s isn't set", AgentSocketEnv)
+	}
+	if err := checkPrivate(filepath.Dir(socket), true); err != nil {
+		return nil, err
+	}
+	if err := checkPrivate(socket, false); err != nil {
+		return nil, err
+	}
+	conn, err := net.DialTimeout("unix", socket, agentDialTimeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(agentDialTimeout))
+	if err := json.NewEncoder(conn).Encode(request); err != nil {
+		return nil, err
+	}
+	response := &agentResponse{}
+	if err := json.NewDecoder(conn).Decode(response); err != nil {
+		return nil, err
+	}
+	if response.Error != "" {
+		return nil, fmt.Errorf("agent: %s", response.Error)
+	}
+	return response, nil
+}
+
+// agentName the name the agent knows a store by, local paths are made
+// absolute so commands run from other directories find the key
+func agentName(store Store) string {
+	abs := func(path string) string {
+		if absolute, err := filepath.Abs(path); err == nil {
+			return absolute
+		}
+		return path
+	}
+	switch s := store.(type) {
+	case *fileStore:
+		return abs(s.path)
+	case *dirStore:
+		return "dir://" + filepath.ToSlash(abs(s.path))
+	case *sqliteStore:
+		return "sqlite://" + filepath.ToSlash(abs(s.path))
+	}
+	return store.String()
+}
+
+// agentDataKey a data key held by the agent, it unlocks the file without a
+// key slot so the passphrase of a slot can't be changed with it
+type agentDataKey []byte
+
+func (k agentDataKey) unwrap(s *SecretsFile) ([]byte, error) {
+	return append([]byte{}, k...), nil
+}
+
+func askAgent(store Store) Key {
+	response, err := callAgent(&agentRequest{Op: "get", File: agentName(store)})
+	if err != nil || response.Key == nil {
+		return nil
+	}
+	return agentDataKey(response.Key)
+}
+
+// AgentKey asks the agent for the key of the file, returns false when no
+// agent is running or the file isn't unlocked
+func AgentKey(file string) (Key, bool) {
+	store, err := OpenStore(file)
+	if err != nil {
+		return nil, false
+	}
+	key := askAgent(store)
+	return key, key != nil
+}
+
+// AddToAgent hands the data key to the agent, so commands can unlock the
+// file without the passphrase until it's idle for the agent's timeout
+func (s *SecretsFile) AddToAgent() error {
+	_, err := callAgent(&agentRequest{Op: "add", File: agentName(s.store), Key: s.dataKey})
+	return err
+}
+
+// LockAgent drops the key of the file from the agent, or every key when
+// file is empty. Returns how many keys were dropped.
+func LockAgent(file string) (int, error) {
+	name := ""
+	if file != "" {
+		store, err := OpenStore(file)
+		if err != nil {
+			return 0, err
+		}
+		name = agentName(store)
+	}
+	response, err := callAgent(&agentRequest{Op: "lock", File: name})
+	if err != nil {
+		return 0, err
+	}
+	return response.Dropped, nil
+}
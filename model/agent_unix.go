@@ -0,0 +1,34 @@
+//go:build !windows
+// +build !windows
+
+package model
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// checkPrivate refuses a directory or socket that is a symlink, belongs to
+// another user or that other users can open, so data keys are only handed
+// to the user's own agent
+func checkPrivate(path string, dir bool) error {
+	info, err := os.Lstat(path)
+	if err != nil {
+		return err
+	}
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	switch {
+	case info.Mode()&os.ModeSymlink != 0:
+		return fmt.Errorf("%s is a symlink", path)
+	case dir && !info.IsDir():
+		return fmt.Errorf("%s is not a directory", path)
+	case !dir && info.Mode()&os.ModeSocket == 0:
+		return fmt.Errorf("%s is not a socket", path)
+	case !ok || int(stat.Uid) != os.Getuid():
+		return fmt.Errorf("%s belongs to another user", path)
+	case info.Mode().Perm()&0077 != 0:
+		return fmt.Errorf("%s can be opened by other users, it must be mode 0700", path)
+	}
+	return nil
+}
@@ -0,0 +1,7 @@
+package model
+
+// checkPrivate windows keeps who can open a file in its access control
+// list, which the temp dir of a user already limits to them
+func checkPrivate(path string, dir bool) error {
+	return nil
+}
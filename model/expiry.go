@@ -0,0 +1,131 @@
+package model
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultDueWithin how long before its deadline a secret is due soon
+const DefaultDueWithin = "14d"
+
+// ExpiryStatus where a secret is relative to its deadline
+type ExpiryStatus int
+
+const (
+	// NoDeadline the secret never has to be rotated
+	NoDeadline ExpiryStatus = iota
+	// NotDue the deadline is further away than the warning window
+	NotDue
+	// DueSoon the deadline is within the warning window
+	DueSoon
+	// Overdue the deadline has passed
+	Overdue
+)
+
+// ParseInterval parses a Go duration, or a whole number of days or weeks
+// such as 90d or 2w
+func ParseInterval(interval string) (time.Duration, error) {
+	interval = strings.TrimSpace(interval)
+	for suffix, unit := range map[string]time.Duration{"d": 24 * time.Hour, "w": 7 * 24 * time.Hour} {
+		if strings.HasSuffix(interval, suffix) {
+			n, err := strconv.Atoi(strings.TrimSuffix(interval, suffix))
+			if err != nil || n <= 0 {
+				return 0, fmt.Errorf("invalid interval: %s", interval)
+			}
+			return time.Duration(n) * unit, nil
+		}
+	}
+	duration, err := time.ParseDuration(interval)
+	if err != nil || duration <= 0 {
+		return 0, fmt.Errorf("invalid interval, use a number of days (90d), weeks (2w) or a duration (36h): %s", interval)
+	}
+	return duration, nil
+}
+
+// ParseExpiry parses a date, a time in RFC3339, or an interval from now
+func ParseExpiry(expires string, now time.Time) (time.Time, error) {
+	expires = strings.TrimSpace(expires)
+	if when, err := time.Parse("2006-01-02", expires); err == nil {
+		return when, nil
+	}
+	if when, err := time.Parse(time.RFC3339, expires); err == nil {
+		return when.UTC(), nil
+	}
+	interval, err := ParseInterval(expires)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("expiry must be a date (2006-01-02), a time (RFC3339) or an interval from now (90d): %s", expires)
+	}
+	return now.Add(interval).UTC(), nil
+}
+
+// SetRotateEvery sets how often the value has to change, empty removes it
+func (s *Secret) SetRotateEvery(interval string) error {
+	if interval != "" {
+		if _, err := ParseInterval(interval); err != nil {
+			return err
+		}
+	}
+	s.RotateEvery = interval
+	return nil
+}
+
+func (s *Secret) hasDeadline() bool {
+	return s.Expires != nil || s.RotateEvery != ""
+}
+
+// Deadline when the secret expires or its current value is due to be
+// rotated, whichever is first. Nil when there is no deadline.
+func (s *Secret) Deadline() *time.Time {
+	deadline := s.Expires
+	if rotate := s.rotationDeadline(); rotate != nil && (deadline == nil || rotate.Before(*deadline)) {
+		deadline = rotate
+	}
+	return deadline
+}
+
+// rotationDeadline when the current value is due to be rotated, nil when
+// the secret doesn't have to be rotated
+func (s *Secret) rotationDeadline() *time.Time {
+	interval, err := ParseInterval(s.RotateEvery)
+	if s.RotateEvery == "" || err != nil {
+		return nil
+	}
+	since := s.VersionCreated
+	if since == nil {
+		since = s.Created
+	}
+	if since == nil {
+		return nil
+	}
+	rotate := since.Add(interval)
+	return &rotate
+}
+
+// ExpiryStatus whether the deadline has passed, or is within dueWithin of now
+func (s *Secret) ExpiryStatus(now time.Time, dueWithin time.Duration) ExpiryStatus {
+	deadline := s.Deadline()
+	switch {
+	case deadline == nil:
+		return NoDeadline
+	case !now.Before(*deadline):
+		return Overdue
+	case now.Add(dueWithin).After(*deadline):
+		return DueSoon
+	}
+	return NotDue
+}
+
+// Expired returns true once the secret's expiry has passed, an expired
+// secret shouldn't be handed out to services
+func (s *Secret) Expired(now time.Time) bool {
+	return s.Expires != nil && !now.Before(*s.Expires)
+}
+
+// RotationDue returns true once the current value is older than the
+// rotation interval. It is a warning, the value is still handed out.
+func (s *Secret) RotationDue(now time.Time) bool {
+	rotate := s.rotationDeadline()
+	return rotate != nil && !now.Before(*rotate)
+}
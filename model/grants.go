@@ -0,0 +1,242 @@
+package model
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"time"
+)
+
+// Grant a copy of a secret's value for a service on its access list,
+// encrypted with the service's key so the service's token can read it
+// without the data key
+type Grant struct {
+	Service    string `json:"service"`
+	Ciphertext []byte `json:"secret"`
+}
+
+func grantName(secret string, service string) string {
+	return fmt.Sprintf("%s:%s", service, secret)
+}
+
+// newServiceKey gives the service a new key, wrapped with the token. The
+// copy encrypted with the data key and the grants follow on the next save.
+func (s *Service) newServiceKey(token []byte) error {
+	key := make([]byte, keyLength)
+	if _, err := io.ReadFull(rand.Reader, key); err != nil {
+		return err
+	}
+	tokenKey := &Slot{}
+	if err := tokenKey.wrap(string(token), key); err != nil {
+		return err
+	}
+	s.key = key
+	s.Key = nil
+	s.TokenKey = tokenKey
+	s.rekeyed = true
+	return nil
+}
+
+// grant keeps the service keys and the grants of every secret in step with
+// the access lists. Grants are only encrypted again when the value or the
+// service's key changed. Services without a key get one while their token
+// is known, hashed services from before grants only get one with a new token.
+func (s *SecretsFile) grant(dataKey []byte) error {
+	services := map[string]*Service{}
+	for _, service := range s.Services {
+		if service.key == nil && !service.Hashed() && service.Secret != nil {
+			if err := service.newServiceKey(service.Secret); err != nil {
+				return err
+			}
+		}
+		if service.key == nil {
+			continue
+		}
+		if service.Key == nil || service.rekeyed {
+			key, err := encryptValue(service.key, dataKey, additionalData("service key", service.Name))
+			if err != nil {
+				return err
+			}
+			service.Key = key
+		}
+		services[service.Name] = service
+	}
+	for _, secret := range s.Secrets {
+		existing := map[string]*Grant{}
+		for _, grant := range secret.Grants {
+			existing[grant.Service] = grant
+		}
+		grants := []*Grant{}
+		for _, name := range secret.Access {
+			service, ok := services[name]
+			if !ok {
+				continue
+			}
+			if grant, ok := existing[name]; ok && !secret.Dirty() && !service.rekeyed {
+				grants = append(grants, grant)
+				continue
+			}
+			ciphertext, err := encryptValue(secret.Secret, service.key, additionalData("grant", grantName(secret.Name, name)))
+			if err != nil {
+				return err
+			}
+			grants = append(grants, &Grant{Service: name, Ciphertext: ciphertext})
+		}
+		secret.Grants = nil
+		if len(grants) > 0 {
+			secret.Grants = grants
+		}
+	}
+	return nil
+}
+
+// grantsMac covers the names of the secrets with a grant for the service,
+// so a grant spliced in from an earlier save is caught with the service key
+func (s *SecretsFile) grantsMac(service string, key []byte) ([]byte, error) {
+	names := []string{"grants", service}
+	for _, secret := range s.Secrets {
+		for _, grant := range secret.Grants {
+			if grant.Service == service {
+				names = append(names, secret.Name)
+			}
+		}
+	}
+	return computeMac(key, grantsMacInfo, names)
+}
+
+// checkGrantsMac files from before version 9 have no grants mac until they
+// are saved again
+func (s *SecretsFile) checkGrantsMac(service *Service, key []byte) error {
+	if s.NamesMac != nil {
+		return nil
+	}
+	if service.GrantsMac == nil {
+		return fmt.Errorf("service has no grants mac")
+	}
+	expected, err := s.grantsMac(service.Name, key)
+	if err != nil {
+		return err
+	}
+	if !hmac.Equal(service.GrantsMac, expected) {
+		return fmt.Errorf("grants were added or removed")
+	}
+	return nil
+}
+
+// checkGrants decrypts the service keys and every grant with them
+func (s *SecretsFile) checkGrants(dataKey []byte) []*IntegrityError {
+	problems := []*IntegrityError{}
+	for _, service := range s.Services {
+		if service.Key == nil {
+			continue
+		}
+		key, err := decryptValue(service.Key, dataKey, additionalData("service key", service.Name))
+		if err != nil {
+			problems = append(problems, &IntegrityError{Kind: "service key", Name: service.Name, Err: err})
+			continue
+		}
+		service.key = key
+		if err := s.checkGrantsMac(service, key); err != nil {
+			problems = append(problems, &IntegrityError{Kind: "grants", Name: service.Name, Err: err})
+		}
+	}
+	for _, secret := range s.Secrets {
+		for _, grant := range secret.Grants {
+			service, ok := s.HasService(grant.Service)
+			if !ok || service.key == nil {
+				problems = append(problems, &IntegrityError{Kind: "grant", Name: grantName(secret.Name, grant.Service), Err: fmt.Errorf("no such service")})
+				continue
+			}
+			value, err := decryptValue(grant.Ciphertext, service.key, additionalData("grant", grantName(secret.Name, grant.Service)))
+			if err == nil && secret.Secret != nil && !bytes.Equal(value, secret.Secret) {
+				err = fmt.Errorf("value differs from the secret")
+			}
+			if err != nil {
+				problems = append(problems, &IntegrityError{Kind: "grant", Name: grantName(secret.Name, grant.Service), Err: err})
+			}
+		}
+	}
+	return problems
+}
+
+// LoadServiceSecrets unlocks the secrets a service can read with its
+// token, as add-access printed it, without the passphrase. Only secrets
+// whose access list names the service are returned, and not expired ones,
+// which is what the service is given in production.
+func LoadServiceSecrets(file string, serviceName string, token []byte) ([]*Secret, error) {
+	secretsFile, err := ReadSecretsFile(file)
+	if err != nil {
+		return nil, err
+	}
+	service, ok := secretsFile.HasService(serviceName)
+	if !ok {
+		return nil, fmt.Errorf("could not find service: %s", serviceName)
+	}
+	if service.TokenKey == nil {
+		return nil, fmt.Errorf("service %s has no key its token unlocks, rotate its token to give it one", serviceName)
+	}
+	key, err := service.TokenKey.unwrap(string(token))
+	if err != nil {
+		return nil, fmt.Errorf("token does not unlock service %s", serviceName)
+	}
+	if err := secretsFile.checkGrantsMac(service, key); err != nil {
+		return nil, &IntegrityError{Kind: "grants", Name: serviceName, Err: err}
+	}
+	now := time.Now()
+	secrets := []*Secret{}
+	for _, secret := range secretsFile.Secrets {
+		if !secret.hasAccess(serviceName) || secret.Expired(now) {
+			continue
+		}
+		for _, grant := range secret.Grants {
+			if grant.Service != serviceName {
+				continue
+			}
+			value, err := decryptValue(grant.Ciphertext, key, additionalData("grant", grantName(secret.Name, serviceName)))
+			if err != nil {
+				return nil, &IntegrityError{Kind: "grant", Name: grantName(secret.Name, serviceName), Err: err}
+			}
+			secrets = append(secrets, &Secret{
+				Name:           secret.Name,
+				Secret:         value,
+				Access:         secret.Access,
+				Version:        secret.Version,
+				VersionCreated: secret.VersionCreated,
+				Description:    secret.Description,
+				Owner:          secret.Owner,
+				Tags:           secret.Tags,
+				Created:        secret.Created,
+				Updated:        secret.Updated,
+				Expires:        secret.Expires,
+				RotateEvery:    secret.RotateEvery,
+			})
+		}
+	}
+	return secrets, nil
+}
+
+// ExpiredForService returns true when the secret is on the service's access
+// list but past its expiry, which is why LoadServiceSecrets left it out
+func ExpiredForService(file string, serviceName string, secretName string) (bool, error) {
+	secretsFile, err := ReadSecretsFile(file)
+	if err != nil {
+		return false, err
+	}
+	i := secretsFile.IndexOfSecret(secretName)
+	if i == -1 {
+		return false, nil
+	}
+	secret := secretsFile.Secrets[i]
+	return secret.hasAccess(serviceName) && secret.Expired(time.Now()), nil
+}
+
+func (s *Secret) hasAccess(service string) bool {
+	for _, name := range s.Access {
+		if name == service {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,121 @@
+package model
+
+import (
+	"bytes"
+	"fmt"
+	"time"
+)
+
+// DefaultRetention how many previous versions of each secret are kept when
+// the file doesn't set its own retention
+const DefaultRetention = 10
+
+// SecretVersion a previous value of a secret, encrypted and bound to the
+// secret and version number so it can't be passed off as another value
+type SecretVersion struct {
+	Version    int        `json:"version"`
+	Created    *time.Time `json:"created,omitempty"`
+	Ciphertext []byte     `json:"secret,omitempty"`
+}
+
+func historyName(name string, version int) string {
+	return fmt.Sprintf("%s:%d", name, version)
+}
+
+// CurrentVersion the version number of the current value, secrets written
+// before versions were kept are at version 1
+func (s *Secret) CurrentVersion() int {
+	if s.Version == 0 {
+		return 1
+	}
+	return s.Version
+}
+
+// RetainedVersions how many previous versions of each secret the file keeps
+func (s *SecretsFile) RetainedVersions() int {
+	if s.Retention == nil {
+		return DefaultRetention
+	}
+	return *s.Retention
+}
+
+// SetRetention changes how many previous versions of each secret are kept,
+// older versions are dropped on the next save
+func (s *SecretsFile) SetRetention(versions int) error {
+	if versions < 0 {
+		return fmt.Errorf("retention can't be negative")
+	}
+	s.Retention = &versions
+	for _, secret := range s.Secrets {
+		secret.trimHistory(versions)
+	}
+	return nil
+}
+
+func (s *Secret) trimHistory(retention int) {
+	if len(s.History) > retention {
+		s.History = s.History[len(s.History)-retention:]
+	}
+	if len(s.History) == 0 {
+		s.History = nil
+	}
+}
+
+// SetSecret adds the secret, or gives it a new value and keeps the previous
+// one in its history. Returns the secret and whether it was added.
+func (s *SecretsFile) SetSecret(name string, value []byte) (*Secret, bool, error) {
+	now := time.Now().UTC()
+	i := s.IndexOfSecret(name)
+	if i == -1 {
+		secret := &Secret{Name: name, Secret: value, Version: 1, VersionCreated: &now}
+		s.Secrets = append(s.Secrets, secret)
+		return secret, true, nil
+	}
+	secret := s.Secrets[i]
+	if bytes.Equal(secret.Secret, value) {
+		// not a new version
+		return secret, false, nil
+	}
+	if retention := s.RetainedVersions(); retention > 0 {
+		previous := secret.CurrentVersion()
+		ciphertext, err := encryptValue(secret.Secret, s.dataKey, additionalData("history", historyName(name, previous)))
+		if err != nil {
+			return nil, false, err
+		}
+		secret.History = append(secret.History, &SecretVersion{Version: previous, Created: secret.VersionCreated, Ciphertext: ciphertext})
+		secret.trimHistory(retention)
+	}
+	secret.Secret = value
+	secret.Version = secret.CurrentVersion() + 1
+	secret.VersionCreated = &now
+	return secret, false, nil
+}
+
+// SecretVersionValue decrypts a version of a secret, the current one or one
+// from its history
+func (s *SecretsFile) SecretVersionValue(name string, version int) ([]byte, error) {
+	i := s.IndexOfSecret(name)
+	if i == -1 {
+		return nil, fmt.Errorf("could not find secret: %s", name)
+	}
+	secret := s.Secrets[i]
+	if version == secret.CurrentVersion() {
+		return secret.Secret, nil
+	}
+	for _, previous := range secret.History {
+		if previous.Version == version {
+			return decryptValue(previous.Ciphertext, s.dataKey, additionalData("history", historyName(name, version)))
+		}
+	}
+	return nil, fmt.Errorf("secret %s has no version %d", name, version)
+}
+
+// Rollback makes a previous version the current value again, as a new version
+func (s *SecretsFile) Rollback(name string, version int) (*Secret, error) {
+	value, err := s.SecretVersionValue(name, version)
+	if err != nil {
+		return nil, err
+	}
+	secret, _, err := s.SetSecret(name, value)
+	return secret, err
+}
@@ -0,0 +1,250 @@
+package model
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+const (
+	fileMacInfo   = "secrets file mac"
+	entryMacInfo  = "secrets entry mac"
+	legacyMacInfo = "secrets access list mac"
+	grantsMacInfo = "secrets service grants mac"
+)
+
+// IntegrityError the file was modified outside of this tool, or is corrupt
+type IntegrityError struct {
+	Kind string
+	Name string
+	Err  error
+}
+
+func (e *IntegrityError) Error() string {
+	if e.Name == "" {
+		return fmt.Sprintf("integrity check failed for %s: %v", e.Kind, e.Err)
+	}
+	return fmt.Sprintf("integrity check failed for %s %s: %v", e.Kind, e.Name, e.Err)
+}
+
+// VerifySecretsFile unlocks the file and reports every entry that fails its
+// integrity checks, where loading the file stops at the first one
+func VerifySecretsFile(file string, key Key) ([]*IntegrityError, error) {
+	store, err := OpenStore(file)
+	if err != nil {
+		return nil, err
+	}
+	secretsFile := &SecretsFile{}
+	dataKey, err := secretsFile.open(store, key)
+	if err != nil {
+		return nil, err
+	}
+	return secretsFile.check(dataKey), nil
+}
+
+// subKey derives an independent key from the data key for another purpose
+func subKey(key []byte, info string) ([]byte, error) {
+	derived := make([]byte, keyLength)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, key, nil, []byte(info)), derived); err != nil {
+		return nil, err
+	}
+	return derived, nil
+}
+
+func additionalData(kind string, name string) []byte {
+	return []byte(kind + ":" + name)
+}
+
+func computeMac(key []byte, info string, value interface{}) ([]byte, error) {
+	macKey, err := subKey(key, info)
+	if err != nil {
+		return nil, err
+	}
+	data, err := json.Marshal(value)
+	if err != nil {
+		return nil, err
+	}
+	mac := hmac.New(sha256.New, macKey)
+	mac.Write(data)
+	return mac.Sum(nil), nil
+}
+
+// fileMac covers every secret and service as they are written, with their
+// macs, ciphertexts, grants and service keys, so entries can't be added,
+// removed, reordered or replaced with a copy from an earlier save
+func (s *SecretsFile) fileMac(key []byte) ([]byte, error) {
+	secrets, services := s.Secrets, s.Services
+	if secrets == nil {
+		secrets = []*Secret{}
+	}
+	if services == nil {
+		services = []*Service{}
+	}
+	return computeMac(key, fileMacInfo, []interface{}{secrets, services, s.Retention})
+}
+
+// namesMac the version 8 file mac, over only the names of the entries
+func (s *SecretsFile) namesMac(key []byte) ([]byte, error) {
+	secrets, services := []string{}, []string{}
+	for _, secret := range s.Secrets {
+		secrets = append(secrets, secret.Name)
+	}
+	for _, service := range s.Services {
+		services = append(services, service.Name)
+	}
+	if s.Retention != nil {
+		return computeMac(key, fileMacInfo, []interface{}{secrets, services, *s.Retention})
+	}
+	return computeMac(key, fileMacInfo, [][]string{secrets, services})
+}
+
+func (s *Secret) mac(key []byte) ([]byte, error) {
+	return computeMac(key, entryMacInfo, s.macData())
+}
+
+// macData what the mac of a secret covers, entries without versions or
+// metadata keep the mac they were written with
+func (s *Secret) macData() interface{} {
+	if s.Version == 0 && len(s.History) == 0 && !s.hasMetadata() && !s.hasDeadline() {
+		return append([]string{"secret", s.Name}, s.Access...)
+	}
+	// the versions, the values are bound to them with additional data
+	versions := []interface{}{s.Version, s.VersionCreated}
+	for _, previous := range s.History {
+		versions = append(versions, previous.Version, previous.Created)
+	}
+	// an empty access list is left out of the file, so it loads as nil
+	access := append([]string{}, s.Access...)
+	data := []interface{}{"secret", s.Name, access, versions}
+	if s.hasMetadata() {
+		data = append(data, []interface{}{s.Description, s.Owner, s.Tags, s.Created, s.Updated})
+	}
+	if s.hasDeadline() {
+		data = append(data, []interface{}{s.Expires, s.RotateEvery})
+	}
+	return data
+}
+
+func (s *Service) mac(key []byte) ([]byte, error) {
+	if s.Hashed() {
+		return computeMac(key, entryMacInfo, []interface{}{"service", s.Name, s.TokenHash})
+	}
+	return computeMac(key, entryMacInfo, []string{"service", s.Name})
+}
+
+// legacyMac the version 3 mac over every secret name and its access list
+func (s *SecretsFile) legacyMac(key []byte) ([]byte, error) {
+	entries := [][]string{}
+	for _, secret := range s.Secrets {
+		entries = append(entries, append([]string{secret.Name}, secret.Access...))
+	}
+	return computeMac(key, legacyMacInfo, entries)
+}
+
+// sign computes every entry mac and then the file mac over the entries,
+// once the values and grants are encrypted for saving
+func (s *SecretsFile) sign(key []byte) error {
+	var err error
+	for _, secret := range s.Secrets {
+		if secret.Mac, err = secret.mac(key); err != nil {
+			return err
+		}
+	}
+	for _, service := range s.Services {
+		if service.Mac, err = service.mac(key); err != nil {
+			return err
+		}
+	}
+	for _, service := range s.Services {
+		service.GrantsMac = nil
+		if service.key != nil {
+			if service.GrantsMac, err = s.grantsMac(service.Name, service.key); err != nil {
+				return err
+			}
+		}
+	}
+	s.LegacyMac = nil
+	s.NamesMac = nil
+	s.Mac, err = s.fileMac(key)
+	return err
+}
+
+// check verifies the macs and decrypts every value, collecting all the
+// problems rather than stopping at the first
+func (s *SecretsFile) check(key []byte) []*IntegrityError {
+	problems := []*IntegrityError{}
+	verify := func(kind string, name string, mac []byte, expected []byte, err error) {
+		if err != nil {
+			problems = append(problems, &IntegrityError{Kind: kind, Name: name, Err: err})
+		} else if mac == nil {
+			problems = append(problems, &IntegrityError{Kind: kind, Name: name, Err: fmt.Errorf("entry has no mac, it was not added by this tool")})
+		} else if !hmac.Equal(mac, expected) {
+			problems = append(problems, &IntegrityError{Kind: kind, Name: name, Err: fmt.Errorf("entry was modified")})
+		}
+	}
+	// files written before values were bound to their entries have no mac
+	bound := s.Mac != nil || s.LegacyMac != nil || s.NamesMac != nil
+	// reported after the problems with single entries, which say more
+	listProblems := []*IntegrityError{}
+	if s.LegacyMac != nil {
+		expected, err := s.legacyMac(key)
+		verify("access lists", "", s.LegacyMac, expected, err)
+	} else if s.Mac != nil || s.NamesMac != nil {
+		mac, fileMac := s.Mac, s.fileMac
+		if s.NamesMac != nil {
+			mac, fileMac = s.NamesMac, s.namesMac
+		}
+		expected, err := fileMac(key)
+		if err == nil && !hmac.Equal(mac, expected) {
+			err = fmt.Errorf("secrets or services were added, removed, reordered or replaced")
+		}
+		if err != nil {
+			listProblems = append(listProblems, &IntegrityError{Kind: "entry list", Err: err})
+		}
+		for _, secret := range s.Secrets {
+			expected, err := secret.mac(key)
+			verify("secret", secret.Name, secret.Mac, expected, err)
+		}
+		for _, service := range s.Services {
+			expected, err := service.mac(key)
+			verify("service", service.Name, service.Mac, expected, err)
+		}
+	}
+	decrypt := func(kind string, name string, data []byte) ([]byte, *sealedValue) {
+		var aad []byte
+		if bound {
+			aad = additionalData(kind, name)
+		}
+		value, err := decryptValue(data, key, aad)
+		if err != nil {
+			problems = append(problems, &IntegrityError{Kind: kind, Name: name, Err: err})
+			return nil, nil
+		}
+		if !bound {
+			// not sealed, it is encrypted again with additional data
+			return value, nil
+		}
+		return value, seal(name, value)
+	}
+	s.checksum, _ = decrypt("checksum", "", s.Checksum)
+	if !bound {
+		s.Checksum = nil
+	}
+	for _, secret := range s.Secrets {
+		secret.Secret, secret.sealed = decrypt("secret", secret.Name, secret.Ciphertext)
+		for _, previous := range secret.History {
+			decrypt("history", historyName(secret.Name, previous.Version), previous.Ciphertext)
+		}
+	}
+	for _, service := range s.Services {
+		if !service.Hashed() {
+			service.Secret, service.sealed = decrypt("service", service.Name, service.Ciphertext)
+		}
+	}
+	problems = append(problems, s.checkGrants(key)...)
+	return append(problems, listProblems...)
+}
@@ -0,0 +1,103 @@
+package model
+
+import (
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/scrypt"
+)
+
+const (
+	// KDFArgon2id derives keys with Argon2id
+	KDFArgon2id = "argon2id"
+	// KDFScrypt derives keys with scrypt
+	KDFScrypt = "scrypt"
+	// KDFLegacyMD5 marks version 0 files, which used the unsalted md5 of the
+	// passphrase as the key
+	KDFLegacyMD5 = "md5"
+
+	keyLength  = 32
+	saltLength = 16
+
+	// the most a file may ask for, a crafted file could otherwise make
+	// every command run out of memory or never finish
+	maxArgon2Time    = 16
+	maxArgon2Memory  = 1024 * 1024
+	maxArgon2Threads = 64
+	maxScryptN       = 1 << 20
+	maxScryptR       = 32
+	maxScryptP       = 16
+	maxScryptMemory  = 1 << 30
+)
+
+// KDF describes how the encryption key is derived from the passphrase.
+// Version 0 files, written before the KDF existed, have no descriptor and
+// are marked as using the legacy md5 key when they are migrated.
+type KDF struct {
+	Algorithm string `json:"algorithm,omitempty"`
+	Salt      []byte `json:"salt,omitempty"`
+	// Argon2id cost parameters, memory is in KiB
+	Time    uint32 `json:"time,omitempty"`
+	Memory  uint32 `json:"memory,omitempty"`
+	Threads uint8  `json:"threads,omitempty"`
+	// scrypt cost parameters
+	N int `json:"n,omitempty"`
+	R int `json:"r,omitempty"`
+	P int `json:"p,omitempty"`
+}
+
+// DefaultKDF the algorithm and cost parameters used for new files and for
+// files upgraded from the legacy md5 key. The salt is generated per file.
+var DefaultKDF = KDF{
+	Algorithm: KDFArgon2id,
+	Time:      3,
+	Memory:    64 * 1024,
+	Threads:   4,
+}
+
+// NewKDF returns a copy of DefaultKDF with a fresh random salt
+func NewKDF() (*KDF, error) {
+	kdf := DefaultKDF
+	kdf.Salt = make([]byte, saltLength)
+	if _, err := io.ReadFull(rand.Reader, kdf.Salt); err != nil {
+		return nil, err
+	}
+	return &kdf, nil
+}
+
+// DeriveKey turns the passphrase into an AES key. Cost parameters outside
+// the limits are refused rather than clamped, the key would be wrong anyway.
+func (k *KDF) DeriveKey(passphrase string) ([]byte, error) {
+	if k == nil {
+		return nil, fmt.Errorf("missing kdf")
+	}
+	switch k.Algorithm {
+	case KDFArgon2id:
+		if k.Time == 0 || k.Memory == 0 || k.Threads == 0 ||
+			k.Time > maxArgon2Time || k.Memory > maxArgon2Memory || k.Threads > maxArgon2Threads {
+			return nil, fmt.Errorf("invalid argon2id parameters, time must be 1-%d, memory 1-%d KiB and threads 1-%d", maxArgon2Time, maxArgon2Memory, maxArgon2Threads)
+		}
+		return argon2.IDKey([]byte(passphrase), k.Salt, k.Time, k.Memory, k.Threads, keyLength), nil
+	case KDFLegacyMD5:
+		return nil, fmt.Errorf("the legacy md5 key only unlocks version 0 files")
+	case KDFScrypt:
+		if k.N <= 1 || k.N&(k.N-1) != 0 || k.R <= 0 || k.P <= 0 ||
+			k.N > maxScryptN || k.R > maxScryptR || k.P > maxScryptP || 128*k.N*k.R > maxScryptMemory {
+			return nil, fmt.Errorf("invalid scrypt parameters, n must be a power of two up to %d, r 1-%d, p 1-%d and 128*n*r at most %d bytes", maxScryptN, maxScryptR, maxScryptP, maxScryptMemory)
+		}
+		return scrypt.Key([]byte(passphrase), k.Salt, k.N, k.R, k.P, keyLength)
+	}
+	return nil, fmt.Errorf("unknown kdf algorithm: %s", k.Algorithm)
+}
+
+// legacyKey the unsalted md5 key of version 0 files, written before the
+// KDF existed. Nothing else may use it, slots and token hashes need a KDF.
+func legacyKey(passphrase string) []byte {
+	hasher := md5.New()
+	hasher.Write([]byte(passphrase))
+	return []byte(hex.EncodeToString(hasher.Sum(nil)))
+}
@@ -0,0 +1,117 @@
+package model
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultLockTimeout how long to wait for another process to release the lock
+const DefaultLockTimeout = 10 * time.Second
+
+const lockPollInterval = 50 * time.Millisecond
+
+// FileLock an advisory lock on a secrets file, held on a separate .lock file
+// so that the secrets file itself can be replaced while locked
+type FileLock struct {
+	file      *os.File
+	exclusive bool
+}
+
+// LockError another process held the lock for longer than the timeout
+type LockError struct {
+	File    string
+	Pid     int
+	Timeout time.Duration
+}
+
+func (e *LockError) Error() string {
+	if e.Pid == 0 {
+		return fmt.Sprintf("%s is locked by another process, gave up after %s", e.File, e.Timeout)
+	}
+	return fmt.Sprintf("%s is locked by pid %d, gave up after %s", e.File, e.Pid, e.Timeout)
+}
+
+// LockSecretsFile takes an exclusive lock for changing the file or a shared
+// lock for reading it, waiting up to timeout for other processes
+func LockSecretsFile(file string, exclusive bool, timeout time.Duration) (Unlocker, error) {
+	store, err := OpenStore(file)
+	if err != nil {
+		return nil, err
+	}
+	return store.Lock(exclusive, timeout)
+}
+
+func lockFile(file string, exclusive bool, timeout time.Duration) (*FileLock, error) {
+	lockFile, err := os.OpenFile(file+".lock", os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	deadline := time.Now().Add(timeout)
+	for {
+		locked, err := tryLock(lockFile, exclusive)
+		if err != nil {
+			lockFile.Close()
+			return nil, err
+		}
+		if locked {
+			break
+		}
+		if time.Now().After(deadline) {
+			lockFile.Close()
+			return nil, &LockError{File: file, Pid: lockHolder(file), Timeout: timeout}
+		}
+		time.Sleep(lockPollInterval)
+	}
+	lock := &FileLock{file: lockFile, exclusive: exclusive}
+	if exclusive {
+		// record who holds the lock so that waiting processes can report it,
+		// shared holders leave the file empty
+		if err := lock.setHolder(strconv.Itoa(os.Getpid())); err != nil {
+			lock.Unlock()
+			return nil, err
+		}
+	}
+	return lock, nil
+}
+
+func (l *FileLock) setHolder(pid string) error {
+	if err := l.file.Truncate(0); err != nil {
+		return err
+	}
+	_, err := l.file.WriteAt([]byte(pid), 0)
+	return err
+}
+
+// Unlock releases the lock, an exclusive holder clears its pid first so it
+// isn't reported once it's gone
+func (l *FileLock) Unlock() error {
+	if l == nil || l.file == nil {
+		return nil
+	}
+	var err error
+	if l.exclusive {
+		err = l.setHolder("")
+	}
+	if unlockErr := unlock(l.file); err == nil {
+		err = unlockErr
+	}
+	l.file.Close()
+	l.file = nil
+	return err
+}
+
+func lockHolder(file string) int {
+	data, err := ioutil.ReadFile(file + ".lock")
+	if err != nil {
+		return 0
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil {
+		return 0
+	}
+	return pid
+}
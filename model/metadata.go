@@ -0,0 +1,117 @@
+package model
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ParseTags turns k=v pairs into tags, an empty value removes the tag
+func ParseTags(pairs []string) (map[string]string, error) {
+	tags := map[string]string{}
+	for _, pair := range pairs {
+		parts := strings.SplitN(pair, "=", 2)
+		key := strings.TrimSpace(parts[0])
+		if len(parts) != 2 || key == "" {
+			return nil, fmt.Errorf("tags must be key=value: %s", pair)
+		}
+		tags[key] = strings.TrimSpace(parts[1])
+	}
+	return tags, nil
+}
+
+// SetTags adds or replaces the tags, tags with an empty value are removed
+func (s *Secret) SetTags(tags map[string]string) {
+	for key, value := range tags {
+		if value == "" {
+			delete(s.Tags, key)
+			continue
+		}
+		if s.Tags == nil {
+			s.Tags = map[string]string{}
+		}
+		s.Tags[key] = value
+	}
+	if len(s.Tags) == 0 {
+		s.Tags = nil
+	}
+}
+
+// FormatTags the tags as sorted k=v pairs
+func (s *Secret) FormatTags() string {
+	pairs := []string{}
+	for key, value := range s.Tags {
+		pairs = append(pairs, key+"="+value)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+// SecretFilter selects secrets by their metadata, empty fields match anything
+type SecretFilter struct {
+	Owner string
+	Tags  map[string]string
+	// Search matches part of the name or the description
+	Search string
+}
+
+// Matches returns true if the secret has the owner, every tag and the search text
+func (f *SecretFilter) Matches(secret *Secret) bool {
+	if f.Owner != "" && f.Owner != secret.Owner {
+		return false
+	}
+	for key, value := range f.Tags {
+		if secret.Tags[key] != value {
+			return false
+		}
+	}
+	if f.Search != "" {
+		search := strings.ToLower(f.Search)
+		if !strings.Contains(strings.ToLower(secret.Name), search) && !strings.Contains(strings.ToLower(secret.Description), search) {
+			return false
+		}
+	}
+	return true
+}
+
+func (s *Secret) hasMetadata() bool {
+	return s.Description != "" || s.Owner != "" || len(s.Tags) > 0 || s.Created != nil || s.Updated != nil
+}
+
+// state everything about the secret that its mac covers, to tell whether it
+// changed since it was loaded
+func (s *Secret) state() []byte {
+	state, _ := json.Marshal(s.macData())
+	return state
+}
+
+// touch sets the updated time of every secret that changed since it was
+// loaded or saved, and the created time of new ones
+func (s *SecretsFile) touch() {
+	now := time.Now().UTC()
+	for _, secret := range s.Secrets {
+		// values of files from before values were sealed can't be compared
+		valueChanged := secret.sealed != nil && secret.Dirty()
+		if secret.loadedState != nil && bytes.Equal(secret.loadedState, secret.state()) && !valueChanged {
+			continue
+		}
+		if secret.loadedState == nil && secret.Created == nil {
+			secret.Created = &now
+		}
+		secret.Updated = &now
+	}
+}
+
+// loaded remembers the state of every secret as it is now, and that the
+// service keys are saved
+func (s *SecretsFile) loaded() {
+	for _, secret := range s.Secrets {
+		secret.loadedState = secret.state()
+	}
+	for _, service := range s.Services {
+		service.rekeyed = false
+	}
+}
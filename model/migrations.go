@@ -0,0 +1,212 @@
+package model
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// CurrentVersion the format version written by this version of the tool
+const CurrentVersion = 9
+
+// Migration converts the raw JSON of a secrets file from one format version
+// to the next. Migrations work on the undecrypted document so that they can
+// run without the passphrase.
+type Migration struct {
+	From        int
+	Description string
+	Migrate     func(document map[string]json.RawMessage) error
+}
+
+// To the version the migration produces
+func (m Migration) To() int {
+	return m.From + 1
+}
+
+var migrations = map[int]Migration{}
+
+// RegisterMigration adds a migration step, there can only be one step from any version
+func RegisterMigration(migration Migration) {
+	if _, ok := migrations[migration.From]; ok {
+		panic(fmt.Sprintf("migration from version %d already registered", migration.From))
+	}
+	migrations[migration.From] = migration
+}
+
+func init() {
+	RegisterMigration(Migration{
+		From:        0,
+		Description: "add the format version header, mark files without a kdf as using the legacy md5 key",
+		Migrate: func(document map[string]json.RawMessage) error {
+			if _, ok := document["kdf"]; !ok {
+				document["kdf"] = json.RawMessage(`{"algorithm":"` + KDFLegacyMD5 + `"}`)
+			}
+			return nil
+		},
+	})
+	RegisterMigration(Migration{
+		From:        1,
+		Description: "values are encrypted with a random data key wrapped by the passphrase key, files get one on the next save",
+		Migrate:     unchanged,
+	})
+	RegisterMigration(Migration{
+		From:        2,
+		Description: "move the wrapped data key into the default key slot",
+		Migrate: func(document map[string]json.RawMessage) error {
+			dataKey, ok := document["dataKey"]
+			if !ok {
+				// legacy file encrypted with the passphrase key, it keeps
+				// its kdf and gets slots when it is next saved
+				return nil
+			}
+			slot := map[string]json.RawMessage{
+				"name":    json.RawMessage(`"` + DefaultSlotName + `"`),
+				"kdf":     document["kdf"],
+				"dataKey": dataKey,
+			}
+			slots, err := json.Marshal([]map[string]json.RawMessage{slot})
+			if err != nil {
+				return err
+			}
+			document["slots"] = slots
+			delete(document, "kdf")
+			delete(document, "dataKey")
+			return nil
+		},
+	})
+	RegisterMigration(Migration{
+		From:        3,
+		Description: "keep the access list mac as legacyMac, entries get their own macs on the next save",
+		Migrate: func(document map[string]json.RawMessage) error {
+			if mac, ok := document["mac"]; ok {
+				document["legacyMac"] = mac
+				delete(document, "mac")
+			}
+			return nil
+		},
+	})
+	RegisterMigration(Migration{
+		From:        4,
+		Description: "secrets keep their previous versions, nothing to convert",
+		Migrate:     unchanged,
+	})
+	RegisterMigration(Migration{
+		From:        5,
+		Description: "secrets have a description, owner, tags and timestamps, nothing to convert",
+		Migrate:     unchanged,
+	})
+	RegisterMigration(Migration{
+		From:        6,
+		Description: "secrets can expire or have to be rotated, nothing to convert",
+		Migrate:     unchanged,
+	})
+	RegisterMigration(Migration{
+		From:        7,
+		Description: "services get a key their token unlocks, grants are added on the next save",
+		Migrate:     unchanged,
+	})
+	RegisterMigration(Migration{
+		From:        8,
+		Description: "keep the mac over the entry names as namesMac, the file mac covers whole entries on the next save",
+		Migrate: func(document map[string]json.RawMessage) error {
+			if mac, ok := document["mac"]; ok {
+				document["namesMac"] = mac
+				delete(document, "mac")
+			}
+			return nil
+		},
+	})
+}
+
+// unchanged the step to versions that only add fields, files at the older
+// version are already valid at the newer one. The version still goes up so
+// that older tools refuse the file, they would misread it or drop the new
+// fields when they save it.
+func unchanged(document map[string]json.RawMessage) error {
+	return nil
+}
+
+// Migrate converts the raw secrets file data step by step from the version
+// it declares up to the requested version and returns the migrated data and
+// the steps that were applied
+func Migrate(data []byte, to int) ([]byte, []Migration, error) {
+	document := map[string]json.RawMessage{}
+	if err := json.Unmarshal(data, &document); err != nil {
+		return nil, nil, err
+	}
+	from, err := documentVersion(document)
+	if err != nil {
+		return nil, nil, err
+	}
+	if to > CurrentVersion {
+		return nil, nil, fmt.Errorf("unknown format version %d, the latest is %d", to, CurrentVersion)
+	}
+	if from > to {
+		return nil, nil, fmt.Errorf("cannot migrate down from version %d to %d", from, to)
+	}
+	applied := []Migration{}
+	for version := from; version < to; version++ {
+		migration, ok := migrations[version]
+		if !ok {
+			return nil, nil, fmt.Errorf("no migration from version %d", version)
+		}
+		if err := migration.Migrate(document); err != nil {
+			return nil, nil, fmt.Errorf("migrating from version %d: %v", version, err)
+		}
+		document["version"] = json.RawMessage(fmt.Sprint(migration.To()))
+		applied = append(applied, migration)
+	}
+	if len(applied) == 0 {
+		return data, applied, nil
+	}
+	migrated, err := json.MarshalIndent(document, "", "  ")
+	if err != nil {
+		return nil, nil, err
+	}
+	return migrated, applied, nil
+}
+
+// MigrateFile migrates the secrets file on disk to the requested version,
+// the file is left untouched on a dry run
+func MigrateFile(file string, to int, dryRun bool) ([]Migration, error) {
+	store, err := OpenStore(file)
+	if err != nil {
+		return nil, err
+	}
+	data, version, err := store.Read()
+	if err != nil {
+		return nil, err
+	}
+	migrated, applied, err := Migrate(data, to)
+	if err != nil {
+		return nil, err
+	}
+	if dryRun || len(applied) == 0 {
+		return applied, nil
+	}
+	_, err = store.Write(migrated, version)
+	return applied, err
+}
+
+// upgrade brings data read from disk up to the current version
+func upgrade(data []byte) ([]byte, error) {
+	migrated, _, err := Migrate(data, CurrentVersion)
+	if err != nil {
+		return nil, err
+	}
+	return migrated, nil
+}
+
+func documentVersion(document map[string]json.RawMessage) (int, error) {
+	raw, ok := document["version"]
+	if !ok {
+		return 0, nil
+	}
+	version := 0
+	if err := json.Unmarshal(raw, &version); err != nil {
+		return 0, fmt.Errorf("invalid format version: %s", raw)
+	}
+	if version > CurrentVersion {
+		return 0, fmt.Errorf("file format version %d is newer than this tool supports (%d)", version, CurrentVersion)
+	}
+	return version, nil
+}
@@ -0,0 +1,63 @@
+package model
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+)
+
+// jsonField a field of a JSON object, kept in order so that a document
+// split into rows or files is put back together exactly as it was
+type jsonField struct {
+	Key   string
+	Value json.RawMessage
+}
+
+func decodeObject(data []byte) ([]jsonField, error) {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	if token, err := decoder.Token(); err != nil || token != json.Delim('{') {
+		return nil, fmt.Errorf("expected a JSON object")
+	}
+	fields := []jsonField{}
+	for decoder.More() {
+		token, err := decoder.Token()
+		if err != nil {
+			return nil, err
+		}
+		var value json.RawMessage
+		if err := decoder.Decode(&value); err != nil {
+			return nil, err
+		}
+		compact := &bytes.Buffer{}
+		if err := json.Compact(compact, value); err != nil {
+			return nil, err
+		}
+		fields = append(fields, jsonField{Key: token.(string), Value: compact.Bytes()})
+	}
+	return fields, nil
+}
+
+func encodeObject(fields []jsonField) []byte {
+	buffer := &bytes.Buffer{}
+	buffer.WriteByte('{')
+	for i, field := range fields {
+		if i > 0 {
+			buffer.WriteByte(',')
+		}
+		key, _ := json.Marshal(field.Key)
+		buffer.Write(key)
+		buffer.WriteByte(':')
+		buffer.Write(field.Value)
+	}
+	buffer.WriteByte('}')
+	return buffer.Bytes()
+}
+
+// indentObject renders the fields as json.MarshalIndent would
+func indentObject(fields []jsonField) ([]byte, error) {
+	indented := &bytes.Buffer{}
+	if err := json.Indent(indented, encodeObject(fields), "", "  "); err != nil {
+		return nil, err
+	}
+	return indented.Bytes(), nil
+}
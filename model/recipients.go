@@ -0,0 +1,191 @@
+package model
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/hkdf"
+)
+
+const (
+	publicKeyPrefix  = "secrets-x25519-pub:"
+	privateKeyPrefix = "SECRETS-X25519-KEY:"
+	recipientInfo    = "secrets recipient data key"
+)
+
+// Recipient wraps the data key for the holder of an X25519 private key, the
+// key is wrapped with a key agreed between a one off ephemeral key pair and
+// the recipient's public key
+type Recipient struct {
+	Name      string `json:"name,omitempty"`
+	PublicKey string `json:"publicKey,omitempty"`
+	Ephemeral []byte `json:"ephemeral,omitempty"`
+	DataKey   []byte `json:"dataKey,omitempty"`
+}
+
+// Identity an X25519 private key that unlocks files it is a recipient of
+type Identity struct {
+	private []byte
+	public  []byte
+}
+
+// GenerateIdentity creates a new random identity
+func GenerateIdentity() (*Identity, error) {
+	private := make([]byte, curve25519.ScalarSize)
+	if _, err := io.ReadFull(rand.Reader, private); err != nil {
+		return nil, err
+	}
+	return newIdentity(private)
+}
+
+func newIdentity(private []byte) (*Identity, error) {
+	public, err := curve25519.X25519(private, curve25519.Basepoint)
+	if err != nil {
+		return nil, err
+	}
+	return &Identity{private: private, public: public}, nil
+}
+
+// LoadIdentity reads an identity file, lines starting with # are ignored
+func LoadIdentity(file string) (*Identity, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if !strings.HasPrefix(line, privateKeyPrefix) {
+			return nil, fmt.Errorf("not an identity file: %s", file)
+		}
+		private, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(line, privateKeyPrefix))
+		if err != nil || len(private) != curve25519.ScalarSize {
+			return nil, fmt.Errorf("invalid private key in identity file: %s", file)
+		}
+		return newIdentity(private)
+	}
+	return nil, fmt.Errorf("no private key in identity file: %s", file)
+}
+
+// Save writes the identity file, readable only by the owner
+func (i *Identity) Save(file string) error {
+	contents := fmt.Sprintf("# public key: %s\n%s%s\n", i.PublicKey(), privateKeyPrefix, base64.StdEncoding.EncodeToString(i.private))
+	return ioutil.WriteFile(file, []byte(contents), 0600)
+}
+
+// PublicKey the encoded public key to add as a recipient
+func (i *Identity) PublicKey() string {
+	return publicKeyPrefix + base64.StdEncoding.EncodeToString(i.public)
+}
+
+func (i *Identity) unwrap(s *SecretsFile) ([]byte, error) {
+	publicKey := i.PublicKey()
+	for _, recipient := range s.Recipients {
+		if recipient.PublicKey != publicKey {
+			continue
+		}
+		shared, err := curve25519.X25519(i.private, recipient.Ephemeral)
+		if err != nil {
+			return nil, err
+		}
+		key, err := recipientKey(shared, recipient.Ephemeral, i.public)
+		if err != nil {
+			return nil, err
+		}
+		return decryptValue(recipient.DataKey, key, nil)
+	}
+	return nil, fmt.Errorf("identity is not a recipient of this file")
+}
+
+func parsePublicKey(publicKey string) ([]byte, error) {
+	if !strings.HasPrefix(publicKey, publicKeyPrefix) {
+		return nil, fmt.Errorf("public key must start with %s", publicKeyPrefix)
+	}
+	public, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(publicKey, publicKeyPrefix))
+	if err != nil || len(public) != curve25519.PointSize {
+		return nil, fmt.Errorf("invalid public key: %s", publicKey)
+	}
+	return public, nil
+}
+
+func recipientKey(shared []byte, ephemeral []byte, public []byte) ([]byte, error) {
+	salt := append(append([]byte{}, ephemeral...), public...)
+	key := make([]byte, keyLength)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, shared, salt, []byte(recipientInfo)), key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+func newRecipient(name string, publicKey string, dataKey []byte) (*Recipient, error) {
+	public, err := parsePublicKey(publicKey)
+	if err != nil {
+		return nil, err
+	}
+	ephemeral, err := GenerateIdentity()
+	if err != nil {
+		return nil, err
+	}
+	shared, err := curve25519.X25519(ephemeral.private, public)
+	if err != nil {
+		return nil, err
+	}
+	key, err := recipientKey(shared, ephemeral.public, public)
+	if err != nil {
+		return nil, err
+	}
+	wrapped, err := encryptValue(dataKey, key, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &Recipient{
+		Name:      name,
+		PublicKey: publicKey,
+		Ephemeral: ephemeral.public,
+		DataKey:   wrapped,
+	}, nil
+}
+
+// IndexOfRecipient find the index of the recipient that matches name
+func (s *SecretsFile) IndexOfRecipient(name string) int {
+	for i, recipient := range s.Recipients {
+		if recipient.Name == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// AddRecipient wraps the data key for the holder of the public key's identity
+func (s *SecretsFile) AddRecipient(name string, publicKey string) error {
+	if s.IndexOfRecipient(name) != -1 {
+		return fmt.Errorf("recipient already exists: %s", name)
+	}
+	recipient, err := newRecipient(name, publicKey, s.dataKey)
+	if err != nil {
+		return err
+	}
+	s.Recipients = append(s.Recipients, recipient)
+	return nil
+}
+
+// RemoveRecipient removes a recipient
+func (s *SecretsFile) RemoveRecipient(name string) error {
+	i := s.IndexOfRecipient(name)
+	if i == -1 {
+		return fmt.Errorf("could not find recipient: %s", name)
+	}
+	s.Recipients = append(s.Recipients[:i], s.Recipients[i+1:]...)
+	return nil
+}
@@ -0,0 +1,38 @@
+package model
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// ConflictError the stored file was changed by someone else after it was
+// loaded, saving would overwrite their change
+type ConflictError struct {
+	File           string
+	LoadedRevision int64
+	DiskRevision   int64
+}
+
+func (e *ConflictError) Error() string {
+	if e.LoadedRevision == e.DiskRevision {
+		return fmt.Sprintf("%s was changed by someone else at revision %d since it was loaded", e.File, e.DiskRevision)
+	}
+	return fmt.Sprintf("%s was changed by someone else since it was loaded, loaded revision %d but it is now at revision %d", e.File, e.LoadedRevision, e.DiskRevision)
+}
+
+// conflict describes a save that lost the compare-and-swap with the store
+func (s *SecretsFile) conflict() error {
+	onDisk := struct {
+		Revision int64 `json:"revision"`
+	}{}
+	data, _, err := s.store.Read()
+	if err == nil {
+		json.Unmarshal(data, &onDisk)
+	}
+	return &ConflictError{File: s.store.String(), LoadedRevision: s.Revision, DiskRevision: onDisk.Revision}
+}
+
+// marshal renders the file as it is written to the store
+func (s *SecretsFile) marshal() ([]byte, error) {
+	return json.MarshalIndent(s, "", "  ")
+}
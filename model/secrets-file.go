@@ -1,16 +1,14 @@
 package model
 
 import (
+	"bytes"
 	"crypto/aes"
 	"crypto/cipher"
-	"crypto/md5"
 	"crypto/rand"
-	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"io"
-	"io/ioutil"
-	"os"
+	"time"
 
 	"github.com/logrusorgru/aurora"
 )
@@ -20,106 +18,390 @@ var checksumPhrase = []byte("checksumToEnsureThatThePassPhraseIsAlwaysTheSame")
 // SecretsFile holder of secrets
 type SecretsFile struct {
 	// TODO change to camel case for json as this is used in an API now.
-	Secrets  []*Secret  `json:"secrets,omitempty"`
+	Version int `json:"version"`
+	// Revision goes up by one on every save
+	Revision int64     `json:"revision,omitempty"`
+	Secrets  []*Secret `json:"secrets,omitempty"`
+	// Checksum the encrypted checksum phrase, it only decrypts to the
+	// phrase with the right key
 	Checksum []byte     `json:"checksum,omitempty"`
 	Services []*Service `json:"services,omitempty"`
-	filename string
+	// Slots each wrap the data key that encrypts the values with a
+	// different passphrase
+	Slots []*Slot `json:"slots,omitempty"`
+	// Recipients each wrap the data key for the holder of a private key
+	Recipients []*Recipient `json:"recipients,omitempty"`
+	// KDF only set on legacy files without slots, which encrypt the values
+	// with the passphrase key directly and are upgraded on load
+	KDF *KDF `json:"kdf,omitempty"`
+	// Mac authenticates every secret and service in the file as it was
+	// saved, each entry also carries its own mac. Files without one were
+	// written before values were bound to their entries with additional data.
+	Mac []byte `json:"mac,omitempty"`
+	// LegacyMac the single mac over all access lists of version 3 files
+	LegacyMac []byte `json:"legacyMac,omitempty"`
+	// NamesMac the file mac of version 8 files, over only the entry names
+	NamesMac []byte `json:"namesMac,omitempty"`
+	// Retention how many previous versions of each secret are kept, when
+	// it isn't set DefaultRetention are kept
+	Retention *int `json:"retention,omitempty"`
+	store     Store
+	dataKey   []byte
+	// the slot that was unlocked, change-passphrase re-wraps this slot
+	slot *Slot
+	lock Unlocker
+	// the store's version of the file when it was loaded or last saved
+	loadedVersion string
+	// the decrypted checksum
+	checksum []byte
 }
 
-// Secret name/encrypted bytes/access list to this secret
+// Secret name/value/access list to this secret. The value is kept decrypted
+// in Secret and encrypted in Ciphertext, which is only re-encrypted on save
+// when the value changed. Previous values are kept encrypted in History.
 type Secret struct {
-	Name   string   `json:"name,omitempty"`
-	Secret []byte   `json:"secret,omitempty"`
-	Access []string `json:"access,omitempty"`
+	Name           string           `json:"name,omitempty"`
+	Secret         []byte           `json:"-"`
+	Ciphertext     []byte           `json:"secret,omitempty"`
+	Access         []string         `json:"access,omitempty"`
+	Mac            []byte           `json:"mac,omitempty"`
+	Version        int              `json:"version,omitempty"`
+	VersionCreated *time.Time       `json:"versionCreated,omitempty"`
+	History        []*SecretVersion `json:"history,omitempty"`
+	// Description, Owner and Tags describe what the secret is for and who
+	// looks after it, Created and Updated are kept up to date on save
+	Description string            `json:"description,omitempty"`
+	Owner       string            `json:"owner,omitempty"`
+	Tags        map[string]string `json:"tags,omitempty"`
+	Created     *time.Time        `json:"created,omitempty"`
+	Updated     *time.Time        `json:"updated,omitempty"`
+	// Expires when the secret stops being valid, RotateEvery how long each
+	// value is valid for, such as 90d
+	Expires     *time.Time `json:"expires,omitempty"`
+	RotateEvery string     `json:"rotateEvery,omitempty"`
+	// Grants the value encrypted for each service on the access list
+	Grants []*Grant `json:"grants,omitempty"`
+	sealed *sealedValue
+	// the state of the secret when it was loaded or saved
+	loadedState []byte
 }
 
-// Service encrypted bytes for a service to access a secret
+// Service the token, or a hash of it, for a service to access secrets. The
+// token is kept decrypted in Secret and encrypted in Ciphertext. The
+// service's key, which its grants are encrypted with, is kept encrypted with
+// the data key in Key and wrapped with the token in TokenKey.
 type Service struct {
-	Name   string `json:"name,omitempty"`
-	Secret []byte `json:"secret,omitempty"`
+	Name       string     `json:"name,omitempty"`
+	Secret     []byte     `json:"-"`
+	Ciphertext []byte     `json:"secret,omitempty"`
+	TokenHash  *TokenHash `json:"tokenHash,omitempty"`
+	Mac        []byte     `json:"mac,omitempty"`
+	Key        []byte     `json:"key,omitempty"`
+	TokenKey   *Slot      `json:"tokenKey,omitempty"`
+	// GrantsMac which secrets the service has grants for, keyed with the
+	// service's key so its token can check it without the data key
+	GrantsMac []byte `json:"grantsMac,omitempty"`
+	sealed    *sealedValue
+	key       []byte
+	// the key changed since the file was loaded or saved
+	rekeyed bool
+}
+
+// sealedValue the name and value a ciphertext was encrypted from, while they
+// are unchanged the entry isn't dirty and its ciphertext is reused
+type sealedValue struct {
+	name      string
+	plaintext []byte
+}
+
+func seal(name string, plaintext []byte) *sealedValue {
+	return &sealedValue{name: name, plaintext: append([]byte{}, plaintext...)}
+}
+
+func dirty(sealed *sealedValue, ciphertext []byte, name string, plaintext []byte) bool {
+	return ciphertext == nil || sealed == nil || sealed.name != name || !bytes.Equal(sealed.plaintext, plaintext)
+}
+
+// Dirty returns true if the value changed since it was loaded or saved
+func (s *Secret) Dirty() bool {
+	return dirty(s.sealed, s.Ciphertext, s.Name, s.Secret)
+}
+
+// Dirty returns true if the token changed since it was loaded or saved
+func (s *Service) Dirty() bool {
+	return !s.Hashed() && dirty(s.sealed, s.Ciphertext, s.Name, s.Secret)
 }
 
 // GenerateNewSecretsFile creates a new file with a checksum
 func GenerateNewSecretsFile(file string, passphrase string) error {
+	store, err := OpenStore(file)
+	if err != nil {
+		return err
+	}
+	return generateNewSecretsFile(store, passphrase)
+}
+
+func generateNewSecretsFile(store Store, passphrase string) error {
 	secretsFile := SecretsFile{
-		Checksum: checksumPhrase,
-		filename: file,
+		Version: CurrentVersion,
+		store:   store,
 	}
-	if err := secretsFile.Save(passphrase); err != nil {
+	if err := secretsFile.generateDataKey(passphrase); err != nil {
+		return err
+	}
+	if err := secretsFile.Save(); err != nil {
 		return err
 	}
 	return nil
 }
 
+// Key unlocks the data key of a secrets file, either a Passphrase or an Identity
+type Key interface {
+	unwrap(s *SecretsFile) ([]byte, error)
+}
+
 // LoadOrCreateSecretsFile loads secrets from disk and decrypts them
 // returns an error if something goes wrong in the loading process
 func LoadOrCreateSecretsFile(file string, passphrase string) (*SecretsFile, error) {
-	if _, err := os.Stat(file); os.IsNotExist(err) {
-		fmt.Printf(aurora.Green("Creating: %s\n").String(), aurora.White(file))
-		err = GenerateNewSecretsFile(file, passphrase)
+	store, err := OpenStore(file)
+	if err != nil {
+		return nil, err
+	}
+	return loadOrCreateSecretsFile(store, passphrase)
+}
+
+func loadOrCreateSecretsFile(store Store, passphrase string) (*SecretsFile, error) {
+	exists, err := storeExists(store)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		fmt.Printf(aurora.Green("Creating: %s\n").String(), aurora.White(store))
+		err = generateNewSecretsFile(store, passphrase)
 		if err != nil {
 			return nil, err
 		}
 	}
+	return loadSecretsFile(store, Passphrase(passphrase))
+}
+
+// LoadSecretsFile loads an existing secrets file and decrypts it with the key
+func LoadSecretsFile(file string, key Key) (*SecretsFile, error) {
+	store, err := OpenStore(file)
+	if err != nil {
+		return nil, err
+	}
+	return loadSecretsFile(store, key)
+}
+
+func loadSecretsFile(store Store, key Key) (*SecretsFile, error) {
 	secretsFile := &SecretsFile{}
-	err := secretsFile.load(file, passphrase)
+	err := secretsFile.load(store, key)
 	if err != nil {
 		return nil, err
 	}
 	return secretsFile, nil
 }
 
-func (s *SecretsFile) load(file string, passphrase string) error {
-	bytes, err := ioutil.ReadFile(file)
+// ReadSecretsFile reads the file without decrypting anything, for callers
+// that only need to check service tokens or revisions
+func ReadSecretsFile(file string) (*SecretsFile, error) {
+	store, err := OpenStore(file)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	err = json.Unmarshal(bytes, s)
+	return readSecretsFile(store)
+}
+
+func readSecretsFile(store Store) (*SecretsFile, error) {
+	bytes, version, err := store.Read()
 	if err != nil {
-		return err
+		return nil, err
+	}
+	bytes, err = upgrade(bytes)
+	if err != nil {
+		return nil, err
+	}
+	secretsFile := &SecretsFile{}
+	if err := json.Unmarshal(bytes, secretsFile); err != nil {
+		return nil, err
+	}
+	secretsFile.store = store
+	secretsFile.loadedVersion = version
+	return secretsFile, nil
+}
+
+// SecretsFileExists returns true if the store has a secrets file in it yet
+func SecretsFileExists(file string) (bool, error) {
+	store, err := OpenStore(file)
+	if err != nil {
+		return false, err
+	}
+	return storeExists(store)
+}
+
+func storeExists(store Store) (bool, error) {
+	_, _, err := store.Read()
+	if err == ErrNotFound {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// OpenSecretsFile locks the file, exclusively when it is going to be changed,
+// and loads it. Only a passphrase can create a new file. The lock is held
+// until Close.
+func OpenSecretsFile(file string, key Key, exclusive bool, timeout time.Duration) (*SecretsFile, error) {
+	store, err := OpenStore(file)
+	if err != nil {
+		return nil, err
+	}
+	exists, err := storeExists(store)
+	if err != nil {
+		return nil, err
+	}
+	// creating the file is a change
+	lock, err := store.Lock(exclusive || !exists, timeout)
+	if err != nil {
+		return nil, err
+	}
+	var secretsFile *SecretsFile
+	if passphrase, ok := key.(Passphrase); ok {
+		secretsFile, err = loadOrCreateSecretsFile(store, string(passphrase))
+	} else {
+		secretsFile, err = loadSecretsFile(store, key)
 	}
-	err = s.processSecrets(passphrase, decryptValue)
+	if err != nil {
+		lock.Unlock()
+		return nil, err
+	}
+	secretsFile.lock = lock
+	return secretsFile, nil
+}
+
+// Close releases the lock taken by OpenSecretsFile
+func (s *SecretsFile) Close() error {
+	if s.lock == nil {
+		return nil
+	}
+	err := s.lock.Unlock()
+	s.lock = nil
+	return err
+}
+
+func (s *SecretsFile) load(store Store, unlockKey Key) error {
+	key, err := s.open(store, unlockKey)
 	if err != nil {
 		return err
 	}
-	if string(s.Checksum) != string(checksumPhrase) {
+	if problems := s.check(key); len(problems) > 0 {
+		return problems[0]
+	}
+	if string(s.checksum) != string(checksumPhrase) {
 		return fmt.Errorf("incorrect passphrase")
 	}
-	s.filename = file
+	s.loaded()
+	if len(s.Slots) == 0 {
+		// values were encrypted with the passphrase key, move them to a
+		// wrapped data key which is written on the next save
+		s.KDF = nil
+		return s.generateDataKey(string(unlockKey.(Passphrase)))
+	}
+	s.dataKey = key
 	return nil
 }
 
-func (s *SecretsFile) processSecrets(passphrase string, crypt func([]byte, string) ([]byte, error)) error {
-	newValue, err := crypt(s.Checksum, passphrase)
+// open reads the file and returns the key that decrypts its values
+func (s *SecretsFile) open(store Store, unlockKey Key) ([]byte, error) {
+	read, err := readSecretsFile(store)
+	if err != nil {
+		return nil, err
+	}
+	*s = *read
+	if len(s.Slots) == 0 {
+		passphrase, ok := unlockKey.(Passphrase)
+		if !ok {
+			return nil, fmt.Errorf("files without key slots can only be unlocked with a passphrase")
+		}
+		if s.KDF != nil && s.KDF.Algorithm == KDFLegacyMD5 {
+			return legacyKey(string(passphrase)), nil
+		}
+		return s.KDF.DeriveKey(string(passphrase))
+	}
+	return unlockKey.unwrap(s)
+}
+
+func (s *SecretsFile) generateDataKey(passphrase string) error {
+	s.dataKey = make([]byte, keyLength)
+	if _, err := io.ReadFull(rand.Reader, s.dataKey); err != nil {
+		return err
+	}
+	slot, err := newSlot(DefaultSlotName, passphrase, s.dataKey)
 	if err != nil {
 		return err
 	}
-	s.Checksum = newValue
+	s.Slots = []*Slot{slot}
+	s.slot = slot
+	// everything is encrypted with the new key on the next save
+	s.Checksum = nil
+	for _, secret := range s.Secrets {
+		secret.sealed = nil
+	}
+	for _, service := range s.Services {
+		service.sealed = nil
+		service.Key = nil
+	}
+	return nil
+}
+
+// processSecrets encrypts the values that changed, authenticated with
+// additional data naming its kind and entry so that ciphertext moved between
+// entries fails to decrypt
+func (s *SecretsFile) processSecrets(key []byte) error {
+	encrypt := func(kind string, name string, data []byte) ([]byte, error) {
+		newValue, err := encryptValue(data, key, additionalData(kind, name))
+		if err != nil {
+			return nil, fmt.Errorf("%s %s: %v", kind, name, err)
+		}
+		return newValue, nil
+	}
+	if s.Checksum == nil {
+		newValue, err := encrypt("checksum", "", checksumPhrase)
+		if err != nil {
+			return err
+		}
+		s.Checksum = newValue
+	}
 	for _, secret := range s.Secrets {
-		newValue, err := crypt(secret.Secret, passphrase)
+		if !secret.Dirty() {
+			continue
+		}
+		newValue, err := encrypt("secret", secret.Name, secret.Secret)
 		if err != nil {
 			return err
 		}
-		secret.Secret = newValue
+		secret.Ciphertext = newValue
+		secret.sealed = seal(secret.Name, secret.Secret)
 	}
 	for _, service := range s.Services {
-		newValue, err := crypt(service.Secret, passphrase)
+		if service.Hashed() || !service.Dirty() {
+			continue
+		}
+		newValue, err := encrypt("service", service.Name, service.Secret)
 		if err != nil {
 			return err
 		}
-		service.Secret = newValue
+		service.Ciphertext = newValue
+		service.sealed = seal(service.Name, service.Secret)
 	}
 	return nil
 }
 
-func createHash(key string) string {
-	hasher := md5.New()
-	hasher.Write([]byte(key))
-	return hex.EncodeToString(hasher.Sum(nil))
-}
-
-func encryptValue(data []byte, passphrase string) ([]byte, error) {
-	block, _ := aes.NewCipher([]byte(createHash(passphrase)))
+func encryptValue(data []byte, key []byte, additionalData []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
 	gcm, err := cipher.NewGCM(block)
 	if err != nil {
 		return nil, err
@@ -128,29 +410,46 @@ func encryptValue(data []byte, passphrase string) ([]byte, error) {
 	if _, err = io.ReadFull(rand.Reader, nonce); err != nil {
 		return nil, err
 	}
-	ciphertext := gcm.Seal(nonce, nonce, data, nil)
+	ciphertext := gcm.Seal(nonce, nonce, data, additionalData)
 	return ciphertext, nil
 }
 
-func (s *SecretsFile) decrypt(passphrase string) error {
-	return nil
-}
-
-// Save save this secrets file to disk, encrypted using the passphrase
-func (s *SecretsFile) Save(passphrase string) error {
-	err := s.processSecrets(passphrase, encryptValue)
+// Save save this secrets file to disk, encrypted using the data key. Only
+// the values that changed are encrypted again. The file is replaced
+// atomically, a failed save leaves the previous file as it was. The secrets
+// file can still be used and saved again afterwards.
+func (s *SecretsFile) Save() error {
+	s.touch()
+	// before the values are sealed, grants of changed values are re-encrypted
+	err := s.grant(s.dataKey)
 	if err != nil {
 		return err
 	}
-	data, err := json.MarshalIndent(s, "", "  ")
+	err = s.processSecrets(s.dataKey)
 	if err != nil {
 		return err
 	}
-	ioutil.WriteFile(s.filename, data, 0644)
-	err = s.decrypt(passphrase)
+	err = s.sign(s.dataKey)
 	if err != nil {
 		return err
 	}
+	s.Version = CurrentVersion
+	s.Revision++
+	data, err := s.marshal()
+	if err != nil {
+		s.Revision--
+		return err
+	}
+	version, err := s.store.Write(data, s.loadedVersion)
+	if err != nil {
+		s.Revision--
+		if err == ErrVersionMismatch {
+			return s.conflict()
+		}
+		return err
+	}
+	s.loadedVersion = version
+	s.loaded()
 	return nil
 }
 
@@ -174,8 +473,7 @@ func (s *SecretsFile) IndexOfSecret(name string) int {
 	return -1
 }
 
-func decryptValue(data []byte, passphrase string) ([]byte, error) {
-	key := []byte(createHash(passphrase))
+func decryptValue(data []byte, key []byte, additionalData []byte) ([]byte, error) {
 	block, err := aes.NewCipher(key)
 	if err != nil {
 		return nil, err
@@ -185,8 +483,11 @@ func decryptValue(data []byte, passphrase string) ([]byte, error) {
 		return nil, err
 	}
 	nonceSize := gcm.NonceSize()
+	if len(data) < nonceSize {
+		return nil, fmt.Errorf("ciphertext too short")
+	}
 	nonce, ciphertext := data[:nonceSize], data[nonceSize:]
-	plaintext, err := gcm.Open(nil, nonce, ciphertext, nil)
+	plaintext, err := gcm.Open(nil, nonce, ciphertext, additionalData)
 	if err != nil {
 		return nil, err
 	}
@@ -0,0 +1,128 @@
+package model
+
+import (
+	"fmt"
+)
+
+// DefaultSlotName the slot created with a new file
+const DefaultSlotName = "default"
+
+// Slot wraps the data key with a key derived from one passphrase, so that
+// several people can unlock the same file with their own passphrase
+type Slot struct {
+	Name    string `json:"name,omitempty"`
+	KDF     *KDF   `json:"kdf,omitempty"`
+	DataKey []byte `json:"dataKey,omitempty"`
+}
+
+func newSlot(name string, passphrase string, dataKey []byte) (*Slot, error) {
+	slot := &Slot{Name: name}
+	if err := slot.wrap(passphrase, dataKey); err != nil {
+		return nil, err
+	}
+	return slot, nil
+}
+
+// wrap encrypts the data key with a key encryption key derived from the
+// passphrase using a fresh salt
+func (s *Slot) wrap(passphrase string, dataKey []byte) error {
+	kdf, err := NewKDF()
+	if err != nil {
+		return err
+	}
+	key, err := kdf.DeriveKey(passphrase)
+	if err != nil {
+		return err
+	}
+	wrapped, err := encryptValue(dataKey, key, nil)
+	if err != nil {
+		return err
+	}
+	s.KDF = kdf
+	s.DataKey = wrapped
+	return nil
+}
+
+func (s *Slot) unwrap(passphrase string) ([]byte, error) {
+	key, err := s.KDF.DeriveKey(passphrase)
+	if err != nil {
+		return nil, err
+	}
+	return decryptValue(s.DataKey, key, nil)
+}
+
+// Passphrase unlocks files with a key slot for the passphrase
+type Passphrase string
+
+// unwrap tries the passphrase against every slot and returns the data key
+// from the first one it opens
+func (p Passphrase) unwrap(s *SecretsFile) ([]byte, error) {
+	var lastErr error
+	for _, slot := range s.Slots {
+		dataKey, err := slot.unwrap(string(p))
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		s.slot = slot
+		return dataKey, nil
+	}
+	if lastErr == nil {
+		return nil, fmt.Errorf("file has no key slots")
+	}
+	return nil, fmt.Errorf("passphrase does not open any key slot: %v", lastErr)
+}
+
+// IndexOfSlot find the index of the slot that matches name
+func (s *SecretsFile) IndexOfSlot(name string) int {
+	for i, slot := range s.Slots {
+		if slot.Name == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// UnlockedSlot the name of the slot the file was opened with
+func (s *SecretsFile) UnlockedSlot() string {
+	if s.slot == nil {
+		return ""
+	}
+	return s.slot.Name
+}
+
+// AddSlot adds a slot that unlocks the file with another passphrase
+func (s *SecretsFile) AddSlot(name string, passphrase string) error {
+	if s.IndexOfSlot(name) != -1 {
+		return fmt.Errorf("slot already exists: %s", name)
+	}
+	slot, err := newSlot(name, passphrase, s.dataKey)
+	if err != nil {
+		return err
+	}
+	s.Slots = append(s.Slots, slot)
+	return nil
+}
+
+// RemoveSlot removes a slot, the last slot can't be removed as nothing
+// could open the file afterwards
+func (s *SecretsFile) RemoveSlot(name string) error {
+	i := s.IndexOfSlot(name)
+	if i == -1 {
+		return fmt.Errorf("could not find slot: %s", name)
+	}
+	if len(s.Slots) == 1 {
+		return fmt.Errorf("cannot remove the last slot")
+	}
+	s.Slots = append(s.Slots[:i], s.Slots[i+1:]...)
+	return nil
+}
+
+// ChangePassphrase re-wraps the data key in the unlocked slot with the new
+// passphrase, the secrets themselves stay encrypted with the same data key
+func (s *SecretsFile) ChangePassphrase(passphrase string) error {
+	if s.slot == nil {
+		return fmt.Errorf("file was not unlocked with a passphrase")
+	}
+	return s.slot.wrap(passphrase, s.dataKey)
+}
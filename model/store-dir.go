@@ -0,0 +1,208 @@
+package model
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const manifestFile = "manifest.json"
+
+// dirStore keeps the secrets file as a directory with a file per secret and
+// per service, and a manifest with the rest of the file and the order of the
+// entries. A save only rewrites the files of entries that changed, so a diff
+// of the directory shows which entries were touched.
+//
+//	secrets.d/manifest.json
+//	secrets.d/secrets/mongo-token.json
+//	secrets.d/services/rpm.org.json
+type dirStore struct {
+	path string
+}
+
+func openDirStore(location *url.URL) (Store, error) {
+	path := filepath.FromSlash(location.Host + location.Path)
+	if path == "" {
+		return nil, fmt.Errorf("no path in %s", location)
+	}
+	return &dirStore{path: path}, nil
+}
+
+// dirEntries the lists of the file that are split into a file per entry
+var dirEntries = []string{"secrets", "services"}
+
+// entryFile the file of a named entry, names are escaped so that any name
+// is a single safe file name
+func (d *dirStore) entryFile(list string, name string) string {
+	escaped := strings.Builder{}
+	for i, b := range []byte(name) {
+		if 'A' <= b && b <= 'Z' || 'a' <= b && b <= 'z' || '0' <= b && b <= '9' || b == '-' || b == '_' || b == '.' && i > 0 {
+			escaped.WriteByte(b)
+		} else {
+			fmt.Fprintf(&escaped, "%%%02X", b)
+		}
+	}
+	return filepath.Join(d.path, list, escaped.String()+".json")
+}
+
+func (d *dirStore) Read() ([]byte, string, error) {
+	manifest, err := ioutil.ReadFile(filepath.Join(d.path, manifestFile))
+	if os.IsNotExist(err) {
+		return nil, "", ErrNotFound
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	fields, err := decodeObject(manifest)
+	if err != nil {
+		return nil, "", fmt.Errorf("%s: %v", manifestFile, err)
+	}
+	for i, field := range fields {
+		if !isDirEntryList(field.Key) {
+			continue
+		}
+		names := []string{}
+		if err := json.Unmarshal(field.Value, &names); err != nil {
+			return nil, "", fmt.Errorf("%s: %s: %v", manifestFile, field.Key, err)
+		}
+		entries := [][]byte{}
+		for _, name := range names {
+			entry, err := ioutil.ReadFile(d.entryFile(field.Key, name))
+			if err != nil {
+				return nil, "", err
+			}
+			compact := &bytes.Buffer{}
+			if err := json.Compact(compact, entry); err != nil {
+				return nil, "", fmt.Errorf("%s: %v", d.entryFile(field.Key, name), err)
+			}
+			entries = append(entries, compact.Bytes())
+		}
+		fields[i].Value = append(append([]byte("["), bytes.Join(entries, []byte(","))...), ']')
+	}
+	data, err := indentObject(fields)
+	if err != nil {
+		return nil, "", err
+	}
+	return data, contentVersion(data), nil
+}
+
+func (d *dirStore) Write(data []byte, expectedVersion string) (string, error) {
+	_, version, err := d.Read()
+	if err != nil && err != ErrNotFound {
+		return "", err
+	}
+	if version != expectedVersion {
+		return "", ErrVersionMismatch
+	}
+	fields, err := decodeObject(data)
+	if err != nil {
+		return "", err
+	}
+	// work out every entry file before writing any of them
+	entryFiles := map[string]json.RawMessage{}
+	for i, field := range fields {
+		if !isDirEntryList(field.Key) {
+			continue
+		}
+		entries := []json.RawMessage{}
+		if err := json.Unmarshal(field.Value, &entries); err != nil {
+			return "", fmt.Errorf("%s: %v", field.Key, err)
+		}
+		names := []string{}
+		for _, entry := range entries {
+			named := struct {
+				Name string `json:"name"`
+			}{}
+			if err := json.Unmarshal(entry, &named); err != nil {
+				return "", fmt.Errorf("%s: %v", field.Key, err)
+			}
+			file := d.entryFile(field.Key, named.Name)
+			if _, ok := entryFiles[file]; ok {
+				return "", fmt.Errorf("%s: duplicate entry %s", field.Key, named.Name)
+			}
+			entryFiles[file] = entry
+			names = append(names, named.Name)
+		}
+		fields[i].Value, _ = json.Marshal(names)
+	}
+	for file, entry := range entryFiles {
+		if err := writeIfChanged(file, entry); err != nil {
+			return "", err
+		}
+	}
+	manifest, err := indentObject(fields)
+	if err != nil {
+		return "", err
+	}
+	// the manifest goes last, until it is replaced the entries it lists
+	// are still there
+	if err := writeIfChanged(filepath.Join(d.path, manifestFile), manifest); err != nil {
+		return "", err
+	}
+	for _, list := range dirEntries {
+		files, _ := filepath.Glob(filepath.Join(d.path, list, "*.json"))
+		for _, file := range files {
+			if _, ok := entryFiles[file]; !ok {
+				if err := os.Remove(file); err != nil {
+					return "", err
+				}
+			}
+		}
+	}
+	_, version, err = d.Read()
+	return version, err
+}
+
+func isDirEntryList(key string) bool {
+	for _, list := range dirEntries {
+		if key == list {
+			return true
+		}
+	}
+	return false
+}
+
+// writeIfChanged replaces the file unless it already has the contents
+func writeIfChanged(file string, data json.RawMessage) error {
+	indented := &bytes.Buffer{}
+	if err := json.Indent(indented, data, "", "  "); err != nil {
+		return err
+	}
+	indented.WriteByte('\n')
+	existing, err := ioutil.ReadFile(file)
+	if err == nil && bytes.Equal(existing, indented.Bytes()) {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+		return err
+	}
+	return writeFileAtomic(file, indented.Bytes(), 0644)
+}
+
+func (d *dirStore) Lock(exclusive bool, timeout time.Duration) (Unlocker, error) {
+	return lockFile(d.path, exclusive, timeout)
+}
+
+// Versions a directory only has its current version, its history is
+// whatever keeps the directory, such as git
+func (d *dirStore) Versions() ([]StoreVersion, error) {
+	_, version, err := d.Read()
+	if err != nil {
+		return nil, err
+	}
+	info, err := os.Stat(filepath.Join(d.path, manifestFile))
+	if err != nil {
+		return nil, err
+	}
+	return []StoreVersion{{Version: version, Modified: info.ModTime(), Current: true}}, nil
+}
+
+func (d *dirStore) String() string {
+	return "dir://" + filepath.ToSlash(d.path)
+}
@@ -0,0 +1,77 @@
+package model
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// fileStore a secrets file on the local disk, the version is the sha256 of
+// the contents so changes made without the tool are noticed too
+type fileStore struct {
+	path string
+}
+
+func openFileStore(location *url.URL) (Store, error) {
+	path := filepath.FromSlash(location.Host + location.Path)
+	if path == "" {
+		return nil, fmt.Errorf("no path in %s", location)
+	}
+	return &fileStore{path: path}, nil
+}
+
+func (f *fileStore) Read() ([]byte, string, error) {
+	data, err := ioutil.ReadFile(f.path)
+	if os.IsNotExist(err) {
+		return nil, "", ErrNotFound
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	return data, contentVersion(data), nil
+}
+
+func (f *fileStore) Write(data []byte, expectedVersion string) (string, error) {
+	_, version, err := f.Read()
+	if err != nil && err != ErrNotFound {
+		return "", err
+	}
+	if version != expectedVersion {
+		return "", ErrVersionMismatch
+	}
+	if err := writeFileAtomic(f.path, data, 0644); err != nil {
+		return "", err
+	}
+	return contentVersion(data), nil
+}
+
+func (f *fileStore) Lock(exclusive bool, timeout time.Duration) (Unlocker, error) {
+	return lockFile(f.path, exclusive, timeout)
+}
+
+// Versions a local file only has its current version
+func (f *fileStore) Versions() ([]StoreVersion, error) {
+	_, version, err := f.Read()
+	if err != nil {
+		return nil, err
+	}
+	info, err := os.Stat(f.path)
+	if err != nil {
+		return nil, err
+	}
+	return []StoreVersion{{Version: version, Modified: info.ModTime(), Current: true}}, nil
+}
+
+func (f *fileStore) String() string {
+	return f.path
+}
+
+func contentVersion(data []byte) string {
+	hash := sha256.Sum256(data)
+	return hex.EncodeToString(hash[:])
+}
@@ -0,0 +1,311 @@
+package model
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	s3Service     = "s3"
+	s3Algorithm   = "AWS4-HMAC-SHA256"
+	s3TimeFormat  = "20060102T150405Z"
+	s3DateFormat  = "20060102"
+	defaultRegion = "us-east-1"
+)
+
+// s3Store a secrets file kept as an object in an S3 compatible bucket. The
+// version is the object's ETag and writes are conditional on it, so the
+// bucket needs no locks. A bucket with versioning enabled keeps every save.
+//
+// s3://bucket/path/secrets.json?region=eu-west-1&endpoint=http://localhost:9000
+//
+// Credentials come from AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY and
+// AWS_SESSION_TOKEN. Without an endpoint the AWS endpoint for the region is
+// used, an endpoint is addressed path style as MinIO and most stand-ins expect.
+type s3Store struct {
+	bucket       string
+	key          string
+	region       string
+	endpoint     *url.URL
+	accessKey    string
+	secretKey    string
+	sessionToken string
+	client       *http.Client
+}
+
+func openS3Store(location *url.URL) (Store, error) {
+	key := strings.TrimPrefix(location.Path, "/")
+	if location.Host == "" || key == "" {
+		return nil, fmt.Errorf("s3 location must be s3://bucket/key: %s", location)
+	}
+	query := location.Query()
+	store := &s3Store{
+		bucket:       location.Host,
+		key:          key,
+		region:       firstNonEmpty(query.Get("region"), os.Getenv("AWS_REGION"), os.Getenv("AWS_DEFAULT_REGION"), defaultRegion),
+		accessKey:    os.Getenv("AWS_ACCESS_KEY_ID"),
+		secretKey:    os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		sessionToken: os.Getenv("AWS_SESSION_TOKEN"),
+		client:       &http.Client{Timeout: 30 * time.Second},
+	}
+	if store.accessKey == "" || store.secretKey == "" {
+		return nil, fmt.Errorf("no credentials for %s, set AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY", location)
+	}
+	endpoint := firstNonEmpty(query.Get("endpoint"), os.Getenv("AWS_ENDPOINT_URL_S3"))
+	if endpoint == "" {
+		endpoint = fmt.Sprintf("https://%s.s3.%s.amazonaws.com", store.bucket, store.region)
+	}
+	u, err := url.Parse(endpoint)
+	if err != nil || u.Host == "" {
+		return nil, fmt.Errorf("invalid s3 endpoint: %s", endpoint)
+	}
+	store.endpoint = u
+	return store, nil
+}
+
+func firstNonEmpty(values ...string) string {
+	for _, value := range values {
+		if value != "" {
+			return value
+		}
+	}
+	return ""
+}
+
+func (s *s3Store) Read() ([]byte, string, error) {
+	response, body, err := s.do("GET", nil, nil, nil)
+	if err != nil {
+		return nil, "", err
+	}
+	if response.StatusCode == http.StatusNotFound {
+		return nil, "", ErrNotFound
+	}
+	if response.StatusCode != http.StatusOK {
+		return nil, "", s.responseError(response, body)
+	}
+	return body, response.Header.Get("ETag"), nil
+}
+
+func (s *s3Store) Write(data []byte, expectedVersion string) (string, error) {
+	header := http.Header{}
+	if expectedVersion == "" {
+		header.Set("If-None-Match", "*")
+	} else {
+		header.Set("If-Match", expectedVersion)
+	}
+	header.Set("Content-Type", "application/json")
+	response, body, err := s.do("PUT", nil, header, data)
+	if err != nil {
+		return "", err
+	}
+	switch response.StatusCode {
+	case http.StatusOK:
+		return response.Header.Get("ETag"), nil
+	case http.StatusPreconditionFailed, http.StatusConflict:
+		// 409 is a conditional write that raced another one
+		return "", ErrVersionMismatch
+	case http.StatusNotFound:
+		if expectedVersion != "" {
+			// deleted since it was read
+			return "", ErrVersionMismatch
+		}
+	}
+	return "", s.responseError(response, body)
+}
+
+// Lock buckets have no locks, conditional writes catch concurrent changes
+func (s *s3Store) Lock(exclusive bool, timeout time.Duration) (Unlocker, error) {
+	return noLock{}, nil
+}
+
+type s3ListVersionsResult struct {
+	Versions []struct {
+		Key          string    `xml:"Key"`
+		VersionID    string    `xml:"VersionId"`
+		IsLatest     bool      `xml:"IsLatest"`
+		LastModified time.Time `xml:"LastModified"`
+	} `xml:"Version"`
+	IsTruncated         bool   `xml:"IsTruncated"`
+	NextKeyMarker       string `xml:"NextKeyMarker"`
+	NextVersionIDMarker string `xml:"NextVersionIdMarker"`
+}
+
+// Versions lists the object versions, a bucket without versioning only has
+// the current one
+func (s *s3Store) Versions() ([]StoreVersion, error) {
+	versions := []StoreVersion{}
+	query := url.Values{"versions": {""}, "prefix": {s.key}}
+	for {
+		response, body, err := s.do("GET", query, nil, nil)
+		if err != nil {
+			return nil, err
+		}
+		if response.StatusCode != http.StatusOK {
+			return nil, s.responseError(response, body)
+		}
+		result := s3ListVersionsResult{}
+		if err := xml.Unmarshal(body, &result); err != nil {
+			return nil, fmt.Errorf("reading versions of %s: %v", s, err)
+		}
+		for _, version := range result.Versions {
+			if version.Key != s.key {
+				continue
+			}
+			versions = append(versions, StoreVersion{Version: version.VersionID, Modified: version.LastModified, Current: version.IsLatest})
+		}
+		if !result.IsTruncated {
+			break
+		}
+		query.Set("key-marker", result.NextKeyMarker)
+		query.Set("version-id-marker", result.NextVersionIDMarker)
+	}
+	if len(versions) == 0 {
+		return nil, ErrNotFound
+	}
+	sort.SliceStable(versions, func(i, j int) bool {
+		return versions[i].Modified.After(versions[j].Modified)
+	})
+	return versions, nil
+}
+
+func (s *s3Store) String() string {
+	return "s3://" + s.bucket + "/" + s.key
+}
+
+// do sends a request for the object, or for the bucket when there is a query
+func (s *s3Store) do(method string, query url.Values, header http.Header, body []byte) (*http.Response, []byte, error) {
+	u := *s.endpoint
+	path := strings.TrimSuffix(u.Path, "/")
+	if !strings.HasPrefix(u.Host, s.bucket+".") {
+		path += "/" + s.bucket
+	}
+	if query == nil {
+		path += "/" + s.key
+	} else {
+		path += "/"
+	}
+	u.Path = path
+	u.RawPath = s3Escape(path)
+	u.RawQuery = s3Query(query)
+	request, err := http.NewRequest(method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, nil, err
+	}
+	for name, values := range header {
+		request.Header[name] = values
+	}
+	s.sign(request, body, time.Now().UTC())
+	response, err := s.client.Do(request)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer response.Body.Close()
+	data, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return nil, nil, err
+	}
+	return response, data, nil
+}
+
+type s3Error struct {
+	Code    string `xml:"Code"`
+	Message string `xml:"Message"`
+}
+
+func (s *s3Store) responseError(response *http.Response, body []byte) error {
+	s3Err := s3Error{}
+	if xml.Unmarshal(body, &s3Err) == nil && s3Err.Code != "" {
+		return fmt.Errorf("%s: %s: %s", s, s3Err.Code, s3Err.Message)
+	}
+	return fmt.Errorf("%s: %s", s, response.Status)
+}
+
+// sign adds an AWS signature version 4 Authorization header
+func (s *s3Store) sign(request *http.Request, body []byte, now time.Time) {
+	payloadHash := sha256.Sum256(body)
+	request.Header.Set("X-Amz-Date", now.Format(s3TimeFormat))
+	request.Header.Set("X-Amz-Content-Sha256", hex.EncodeToString(payloadHash[:]))
+	if s.sessionToken != "" {
+		request.Header.Set("X-Amz-Security-Token", s.sessionToken)
+	}
+	signed := []string{"host"}
+	for name := range request.Header {
+		name = strings.ToLower(name)
+		if strings.HasPrefix(name, "x-amz-") || name == "if-match" || name == "if-none-match" || name == "content-type" {
+			signed = append(signed, name)
+		}
+	}
+	sort.Strings(signed)
+	canonicalHeaders := ""
+	for _, name := range signed {
+		value := request.URL.Host
+		if name != "host" {
+			value = strings.TrimSpace(request.Header.Get(name))
+		}
+		canonicalHeaders += name + ":" + value + "\n"
+	}
+	signedHeaders := strings.Join(signed, ";")
+	canonicalRequest := strings.Join([]string{
+		request.Method,
+		request.URL.EscapedPath(),
+		request.URL.RawQuery,
+		canonicalHeaders,
+		signedHeaders,
+		hex.EncodeToString(payloadHash[:]),
+	}, "\n")
+	scope := strings.Join([]string{now.Format(s3DateFormat), s.region, s3Service, "aws4_request"}, "/")
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := strings.Join([]string{s3Algorithm, now.Format(s3TimeFormat), scope, hex.EncodeToString(requestHash[:])}, "\n")
+	key := []byte("AWS4" + s.secretKey)
+	for _, part := range []string{now.Format(s3DateFormat), s.region, s3Service, "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+	request.Header.Set("Authorization", fmt.Sprintf("%s Credential=%s/%s, SignedHeaders=%s, Signature=%s", s3Algorithm, s.accessKey, scope, signedHeaders, signature))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// s3Escape percent encodes everything but the unreserved characters and /
+func s3Escape(path string) string {
+	escaped := strings.Builder{}
+	for _, b := range []byte(path) {
+		if 'A' <= b && b <= 'Z' || 'a' <= b && b <= 'z' || '0' <= b && b <= '9' || strings.IndexByte("-_.~/", b) != -1 {
+			escaped.WriteByte(b)
+		} else {
+			fmt.Fprintf(&escaped, "%%%02X", b)
+		}
+	}
+	return escaped.String()
+}
+
+// s3Query the canonical query string, sorted and encoded as signing requires
+func s3Query(query url.Values) string {
+	keys := []string{}
+	for key := range query {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	parts := []string{}
+	for _, key := range keys {
+		for _, value := range query[key] {
+			parts = append(parts, strings.Replace(s3Escape(key), "/", "%2F", -1)+"="+strings.Replace(s3Escape(value), "/", "%2F", -1))
+		}
+	}
+	return strings.Join(parts, "&")
+}
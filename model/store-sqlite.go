@@ -0,0 +1,506 @@
+package model
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	// registers the pure go sqlite driver
+	_ "modernc.org/sqlite"
+)
+
+const sqliteSchema = `
+CREATE TABLE IF NOT EXISTS store (
+	version  INTEGER NOT NULL,
+	modified TEXT NOT NULL
+);
+CREATE TABLE IF NOT EXISTS metadata (
+	key      TEXT PRIMARY KEY,
+	position INTEGER NOT NULL,
+	value    TEXT
+);
+CREATE TABLE IF NOT EXISTS secrets (
+	name     TEXT PRIMARY KEY,
+	position INTEGER NOT NULL,
+	secret   BLOB,
+	mac      BLOB,
+	extra    TEXT
+);
+CREATE TABLE IF NOT EXISTS access (
+	secret   TEXT NOT NULL REFERENCES secrets(name) ON DELETE CASCADE,
+	position INTEGER NOT NULL,
+	service  TEXT NOT NULL,
+	PRIMARY KEY (secret, position)
+);
+CREATE TABLE IF NOT EXISTS services (
+	name       TEXT PRIMARY KEY,
+	position   INTEGER NOT NULL,
+	secret     BLOB,
+	token_hash TEXT,
+	mac        BLOB,
+	extra      TEXT
+);
+`
+
+// sqliteStore keeps the secrets file in a SQLite database with a row per
+// secret, service and access grant, so a save only touches the rows of the
+// entries that changed. The other fields of the file are rows of metadata.
+// Values are stored exactly as they are in the JSON format, encrypted.
+type sqliteStore struct {
+	path string
+}
+
+func openSQLiteStore(location *url.URL) (Store, error) {
+	path := filepath.FromSlash(location.Host + location.Path)
+	if path == "" {
+		return nil, fmt.Errorf("no path in %s", location)
+	}
+	return &sqliteStore{path: path}, nil
+}
+
+func (s *sqliteStore) open() (*sql.DB, error) {
+	// immediate transactions take the write lock up front so the version
+	// check and the write can't interleave with another writer
+	db, err := sql.Open("sqlite", "file:"+s.path+"?_txlock=immediate&_pragma=busy_timeout(10000)&_pragma=foreign_keys(1)")
+	if err != nil {
+		return nil, err
+	}
+	if _, err := db.Exec(sqliteSchema); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("%s: %v", s.path, err)
+	}
+	return db, nil
+}
+
+// sqliteEntry one row of the secrets or services table
+type sqliteEntry struct {
+	position  int
+	secret    []byte
+	mac       []byte
+	tokenHash sql.NullString
+	extra     sql.NullString
+	access    []string
+}
+
+func (e *sqliteEntry) equal(other *sqliteEntry) bool {
+	if e.position != other.position || !bytes.Equal(e.secret, other.secret) || !bytes.Equal(e.mac, other.mac) ||
+		e.tokenHash != other.tokenHash || e.extra != other.extra || len(e.access) != len(other.access) {
+		return false
+	}
+	for i := range e.access {
+		if e.access[i] != other.access[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// sqliteDocument the secrets file split into rows
+type sqliteDocument struct {
+	metadata map[string]sqliteMetadata
+	secrets  map[string]*sqliteEntry
+	services map[string]*sqliteEntry
+}
+
+type sqliteMetadata struct {
+	position int
+	value    sql.NullString
+}
+
+func (s *sqliteStore) Read() ([]byte, string, error) {
+	if _, err := os.Stat(s.path); os.IsNotExist(err) {
+		// don't leave an empty database behind
+		return nil, "", ErrNotFound
+	}
+	db, err := s.open()
+	if err != nil {
+		return nil, "", err
+	}
+	defer db.Close()
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, "", err
+	}
+	defer tx.Rollback()
+	version, err := sqliteVersion(tx)
+	if err != nil {
+		return nil, "", err
+	}
+	if version == "" {
+		return nil, "", ErrNotFound
+	}
+	document, err := readSQLiteDocument(tx)
+	if err != nil {
+		return nil, "", err
+	}
+	data, err := document.assemble()
+	if err != nil {
+		return nil, "", err
+	}
+	return data, version, nil
+}
+
+func (s *sqliteStore) Write(data []byte, expectedVersion string) (string, error) {
+	document, err := splitDocument(data)
+	if err != nil {
+		return "", err
+	}
+	db, err := s.open()
+	if err != nil {
+		return "", err
+	}
+	defer db.Close()
+	tx, err := db.Begin()
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+	version, err := sqliteVersion(tx)
+	if err != nil {
+		return "", err
+	}
+	if version != expectedVersion {
+		return "", ErrVersionMismatch
+	}
+	stored, err := readSQLiteDocument(tx)
+	if err != nil {
+		return "", err
+	}
+	if err := writeSQLiteDocument(tx, stored, document); err != nil {
+		return "", err
+	}
+	next := int64(1)
+	if version != "" {
+		current, _ := strconv.ParseInt(version, 10, 64)
+		next = current + 1
+	}
+	if _, err := tx.Exec("DELETE FROM store"); err != nil {
+		return "", err
+	}
+	if _, err := tx.Exec("INSERT INTO store (version, modified) VALUES (?, ?)", next, time.Now().UTC().Format(time.RFC3339Nano)); err != nil {
+		return "", err
+	}
+	if err := tx.Commit(); err != nil {
+		return "", err
+	}
+	return strconv.FormatInt(next, 10), nil
+}
+
+func (s *sqliteStore) Lock(exclusive bool, timeout time.Duration) (Unlocker, error) {
+	return lockFile(s.path, exclusive, timeout)
+}
+
+// Versions the database only keeps its current version
+func (s *sqliteStore) Versions() ([]StoreVersion, error) {
+	if _, err := os.Stat(s.path); os.IsNotExist(err) {
+		return nil, ErrNotFound
+	}
+	db, err := s.open()
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+	var version int64
+	var modified string
+	err = db.QueryRow("SELECT version, modified FROM store").Scan(&version, &modified)
+	if err == sql.ErrNoRows {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	when, err := time.Parse(time.RFC3339Nano, modified)
+	if err != nil {
+		return nil, err
+	}
+	return []StoreVersion{{Version: strconv.FormatInt(version, 10), Modified: when, Current: true}}, nil
+}
+
+func (s *sqliteStore) String() string {
+	return "sqlite://" + filepath.ToSlash(s.path)
+}
+
+func sqliteVersion(tx *sql.Tx) (string, error) {
+	var version int64
+	err := tx.QueryRow("SELECT version FROM store").Scan(&version)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	return strconv.FormatInt(version, 10), nil
+}
+
+func readSQLiteDocument(tx *sql.Tx) (*sqliteDocument, error) {
+	document := &sqliteDocument{
+		metadata: map[string]sqliteMetadata{},
+		secrets:  map[string]*sqliteEntry{},
+		services: map[string]*sqliteEntry{},
+	}
+	rows, err := tx.Query("SELECT key, position, value FROM metadata")
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var key string
+		metadata := sqliteMetadata{}
+		if err := rows.Scan(&key, &metadata.position, &metadata.value); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		document.metadata[key] = metadata
+	}
+	rows.Close()
+	rows, err = tx.Query("SELECT name, position, secret, mac, extra FROM secrets")
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var name string
+		entry := &sqliteEntry{}
+		if err := rows.Scan(&name, &entry.position, &entry.secret, &entry.mac, &entry.extra); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		document.secrets[name] = entry
+	}
+	rows.Close()
+	rows, err = tx.Query("SELECT secret, service FROM access ORDER BY secret, position")
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var secret, service string
+		if err := rows.Scan(&secret, &service); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		if entry, ok := document.secrets[secret]; ok {
+			entry.access = append(entry.access, service)
+		}
+	}
+	rows.Close()
+	rows, err = tx.Query("SELECT name, position, secret, token_hash, mac, extra FROM services")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var name string
+		entry := &sqliteEntry{}
+		if err := rows.Scan(&name, &entry.position, &entry.secret, &entry.tokenHash, &entry.mac, &entry.extra); err != nil {
+			return nil, err
+		}
+		document.services[name] = entry
+	}
+	return document, rows.Err()
+}
+
+// writeSQLiteDocument changes only the rows that differ from what is stored
+func writeSQLiteDocument(tx *sql.Tx, stored *sqliteDocument, document *sqliteDocument) error {
+	for key := range stored.metadata {
+		if _, ok := document.metadata[key]; !ok {
+			if _, err := tx.Exec("DELETE FROM metadata WHERE key = ?", key); err != nil {
+				return err
+			}
+		}
+	}
+	for key, metadata := range document.metadata {
+		if old, ok := stored.metadata[key]; ok && old == metadata {
+			continue
+		}
+		if _, err := tx.Exec("INSERT OR REPLACE INTO metadata (key, position, value) VALUES (?, ?, ?)", key, metadata.position, metadata.value); err != nil {
+			return err
+		}
+	}
+	for name := range stored.secrets {
+		if _, ok := document.secrets[name]; !ok {
+			if _, err := tx.Exec("DELETE FROM secrets WHERE name = ?", name); err != nil {
+				return err
+			}
+		}
+	}
+	for name, entry := range document.secrets {
+		if old, ok := stored.secrets[name]; ok && old.equal(entry) {
+			continue
+		}
+		if _, err := tx.Exec("DELETE FROM access WHERE secret = ?", name); err != nil {
+			return err
+		}
+		if _, err := tx.Exec("INSERT OR REPLACE INTO secrets (name, position, secret, mac, extra) VALUES (?, ?, ?, ?, ?)", name, entry.position, entry.secret, entry.mac, entry.extra); err != nil {
+			return err
+		}
+		for i, service := range entry.access {
+			if _, err := tx.Exec("INSERT INTO access (secret, position, service) VALUES (?, ?, ?)", name, i, service); err != nil {
+				return err
+			}
+		}
+	}
+	for name := range stored.services {
+		if _, ok := document.services[name]; !ok {
+			if _, err := tx.Exec("DELETE FROM services WHERE name = ?", name); err != nil {
+				return err
+			}
+		}
+	}
+	for name, entry := range document.services {
+		if old, ok := stored.services[name]; ok && old.equal(entry) {
+			continue
+		}
+		if _, err := tx.Exec("INSERT OR REPLACE INTO services (name, position, secret, token_hash, mac, extra) VALUES (?, ?, ?, ?, ?, ?)", name, entry.position, entry.secret, entry.tokenHash, entry.mac, entry.extra); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// entry columns, the fields of an entry in the order they are written
+var (
+	secretColumns  = []string{"name", "secret", "access", "mac"}
+	serviceColumns = []string{"name", "secret", "tokenHash", "mac"}
+)
+
+// splitDocument turns a secrets file into the rows that store it
+func splitDocument(data []byte) (*sqliteDocument, error) {
+	fields, err := decodeObject(data)
+	if err != nil {
+		return nil, err
+	}
+	document := &sqliteDocument{
+		metadata: map[string]sqliteMetadata{},
+		secrets:  map[string]*sqliteEntry{},
+		services: map[string]*sqliteEntry{},
+	}
+	for position, field := range fields {
+		metadata := sqliteMetadata{position: position}
+		switch field.Key {
+		case "secrets":
+			err = splitEntries(field.Value, document.secrets)
+		case "services":
+			err = splitEntries(field.Value, document.services)
+		default:
+			metadata.value = sql.NullString{String: string(field.Value), Valid: true}
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", field.Key, err)
+		}
+		document.metadata[field.Key] = metadata
+	}
+	return document, nil
+}
+
+func splitEntries(data json.RawMessage, entries map[string]*sqliteEntry) error {
+	list := []json.RawMessage{}
+	if err := json.Unmarshal(data, &list); err != nil {
+		return err
+	}
+	for position, raw := range list {
+		fields, err := decodeObject(raw)
+		if err != nil {
+			return err
+		}
+		var name string
+		entry := &sqliteEntry{position: position}
+		extra := []jsonField{}
+		for _, field := range fields {
+			switch field.Key {
+			case "name":
+				err = json.Unmarshal(field.Value, &name)
+			case "secret":
+				err = json.Unmarshal(field.Value, &entry.secret)
+			case "mac":
+				err = json.Unmarshal(field.Value, &entry.mac)
+			case "access":
+				err = json.Unmarshal(field.Value, &entry.access)
+			case "tokenHash":
+				entry.tokenHash = sql.NullString{String: string(field.Value), Valid: true}
+			default:
+				extra = append(extra, field)
+			}
+			if err != nil {
+				return fmt.Errorf("%s: %v", field.Key, err)
+			}
+		}
+		if _, ok := entries[name]; ok {
+			return fmt.Errorf("duplicate entry %s", name)
+		}
+		if len(extra) > 0 {
+			entry.extra = sql.NullString{String: string(encodeObject(extra)), Valid: true}
+		}
+		entries[name] = entry
+	}
+	return nil
+}
+
+// assemble puts the rows back together into the secrets file
+func (d *sqliteDocument) assemble() ([]byte, error) {
+	fields := make([]jsonField, len(d.metadata))
+	for key, metadata := range d.metadata {
+		if metadata.position < 0 || metadata.position >= len(fields) || fields[metadata.position].Key != "" {
+			return nil, fmt.Errorf("corrupt metadata position for %s", key)
+		}
+		field := jsonField{Key: key, Value: json.RawMessage(metadata.value.String)}
+		switch key {
+		case "secrets":
+			field.Value = assembleEntries(d.secrets, secretColumns)
+		case "services":
+			field.Value = assembleEntries(d.services, serviceColumns)
+		}
+		fields[metadata.position] = field
+	}
+	return indentObject(fields)
+}
+
+func assembleEntries(entries map[string]*sqliteEntry, columns []string) json.RawMessage {
+	ordered := make([][]jsonField, len(entries))
+	for name, entry := range entries {
+		fields := []jsonField{}
+		for _, column := range columns {
+			var value []byte
+			switch column {
+			case "name":
+				if name != "" {
+					value, _ = json.Marshal(name)
+				}
+			case "secret":
+				if entry.secret != nil {
+					value, _ = json.Marshal(entry.secret)
+				}
+			case "mac":
+				if entry.mac != nil {
+					value, _ = json.Marshal(entry.mac)
+				}
+			case "access":
+				if entry.access != nil {
+					value, _ = json.Marshal(entry.access)
+				}
+			case "tokenHash":
+				if entry.tokenHash.Valid {
+					value = []byte(entry.tokenHash.String)
+				}
+			}
+			if value != nil {
+				fields = append(fields, jsonField{Key: column, Value: value})
+			}
+		}
+		if entry.extra.Valid {
+			extra, _ := decodeObject([]byte(entry.extra.String))
+			fields = append(fields, extra...)
+		}
+		if entry.position < len(ordered) {
+			ordered[entry.position] = fields
+		}
+	}
+	list := [][]byte{}
+	for _, fields := range ordered {
+		list = append(list, encodeObject(fields))
+	}
+	return append(append([]byte("["), bytes.Join(list, []byte(","))...), ']')
+}
@@ -0,0 +1,131 @@
+package model
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"reflect"
+	"strings"
+	"time"
+)
+
+var (
+	// ErrNotFound the store has no secrets file yet
+	ErrNotFound = errors.New("secrets file not found")
+	// ErrVersionMismatch the stored file is not at the version the write expected
+	ErrVersionMismatch = errors.New("secrets file changed since it was read")
+)
+
+// Store keeps the bytes of a secrets file somewhere. Versions are opaque
+// strings chosen by the store, writes only succeed while the stored version
+// is still the one that was read.
+type Store interface {
+	// Read returns the contents and their version, or ErrNotFound
+	Read() ([]byte, string, error)
+	// Write replaces the contents if the stored version is expectedVersion,
+	// an empty expectedVersion means the file must not exist yet. Returns
+	// the new version, or ErrVersionMismatch.
+	Write(data []byte, expectedVersion string) (string, error)
+	// Lock takes an advisory lock, exclusive for changes and shared for reads
+	Lock(exclusive bool, timeout time.Duration) (Unlocker, error)
+	// Versions lists the versions the store keeps, newest first
+	Versions() ([]StoreVersion, error)
+	// String the location of the store
+	String() string
+}
+
+// Unlocker releases a lock taken on a store
+type Unlocker interface {
+	Unlock() error
+}
+
+// StoreVersion one version of a secrets file kept by a store
+type StoreVersion struct {
+	Version  string
+	Modified time.Time
+	Current  bool
+}
+
+// StoreOpener opens the store at a location with the opener's scheme
+type StoreOpener func(location *url.URL) (Store, error)
+
+var storeOpeners = map[string]StoreOpener{}
+
+// RegisterStore makes a storage backend available for locations with the scheme
+func RegisterStore(scheme string, opener StoreOpener) {
+	if _, ok := storeOpeners[scheme]; ok {
+		panic(fmt.Sprintf("store already registered for %s://", scheme))
+	}
+	storeOpeners[scheme] = opener
+}
+
+func init() {
+	RegisterStore("file", openFileStore)
+	RegisterStore("s3", openS3Store)
+	RegisterStore("sqlite", openSQLiteStore)
+	RegisterStore("dir", openDirStore)
+}
+
+// OpenStore picks the storage backend from the location's scheme, a plain
+// path is a local file
+func OpenStore(location string) (Store, error) {
+	if !strings.Contains(location, "://") {
+		return &fileStore{path: location}, nil
+	}
+	u, err := url.Parse(location)
+	if err != nil {
+		return nil, err
+	}
+	opener, ok := storeOpeners[u.Scheme]
+	if !ok {
+		return nil, fmt.Errorf("unsupported secrets file location %s, no store for %s://", location, u.Scheme)
+	}
+	return opener(u)
+}
+
+// ConvertSecretsFile copies the secrets file into a new store, which may use
+// another format, without decrypting it. The copy is read back and compared
+// to make sure nothing was lost.
+func ConvertSecretsFile(from string, to string) error {
+	source, err := OpenStore(from)
+	if err != nil {
+		return err
+	}
+	destination, err := OpenStore(to)
+	if err != nil {
+		return err
+	}
+	data, _, err := source.Read()
+	if err != nil {
+		return fmt.Errorf("%s: %v", source, err)
+	}
+	_, err = destination.Write(data, "")
+	if err == ErrVersionMismatch {
+		return fmt.Errorf("%s already exists", destination)
+	}
+	if err != nil {
+		return err
+	}
+	copied, _, err := destination.Read()
+	if err != nil {
+		return err
+	}
+	var original, converted interface{}
+	if err := json.Unmarshal(data, &original); err != nil {
+		return err
+	}
+	if err := json.Unmarshal(copied, &converted); err != nil {
+		return err
+	}
+	if !reflect.DeepEqual(original, converted) {
+		return fmt.Errorf("%s does not read back the same as %s", destination, source)
+	}
+	return nil
+}
+
+type noLock struct{}
+
+func (noLock) Unlock() error {
+	return nil
+}
@@ -0,0 +1,71 @@
+package model
+
+import (
+	"crypto/subtle"
+	"fmt"
+)
+
+// TokenHash a salted, slow hash of a service token. Services with a token
+// hash have no recoverable token, a token can only be checked against it.
+type TokenHash struct {
+	KDF  *KDF   `json:"kdf,omitempty"`
+	Hash []byte `json:"hash,omitempty"`
+}
+
+// Hashed returns true if only a hash of the service token is stored
+func (s *Service) Hashed() bool {
+	return s.TokenHash != nil
+}
+
+// SetToken stores the token encrypted, or only its hash when hashed is true.
+// The service gets a new key so grants the old token unlocked are replaced.
+func (s *Service) SetToken(token []byte, hashed bool) error {
+	if err := s.newServiceKey(token); err != nil {
+		return err
+	}
+	if !hashed {
+		s.Secret = token
+		s.TokenHash = nil
+		return nil
+	}
+	kdf, err := NewKDF()
+	if err != nil {
+		return err
+	}
+	hash, err := kdf.DeriveKey(string(token))
+	if err != nil {
+		return err
+	}
+	s.Secret = nil
+	s.Ciphertext = nil
+	s.sealed = nil
+	s.TokenHash = &TokenHash{KDF: kdf, Hash: hash}
+	return nil
+}
+
+// VerifyToken checks a presented token against the stored hash, it doesn't
+// need the file to be decrypted
+func (s *Service) VerifyToken(token []byte) (bool, error) {
+	if !s.Hashed() {
+		return false, fmt.Errorf("token for %s is encrypted, not hashed", s.Name)
+	}
+	hash, err := s.TokenHash.KDF.DeriveKey(string(token))
+	if err != nil {
+		return false, err
+	}
+	return subtle.ConstantTimeCompare(hash, s.TokenHash.Hash) == 1, nil
+}
+
+// VerifyServiceToken checks a token presented by the named service against
+// its stored hash
+func VerifyServiceToken(file string, serviceName string, token []byte) (bool, error) {
+	secretsFile, err := ReadSecretsFile(file)
+	if err != nil {
+		return false, err
+	}
+	service, ok := secretsFile.HasService(serviceName)
+	if !ok {
+		return false, nil
+	}
+	return service.VerifyToken(token)
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"runtime"
+
+	"golang.org/x/term"
+)
+
+const (
+	// passphraseEnv the environment variable the passphrase can be given in
+	passphraseEnv = "SECRETS_PASSPHRASE"
+	// newPassphraseEnv the environment variable the new passphrase of
+	// change-passphrase and slot add can be given in
+	newPassphraseEnv = "SECRETS_NEW_PASSPHRASE"
+	// serviceTokenEnv the environment variable the token of --as-service
+	// can be given in
+	serviceTokenEnv = "SECRETS_SERVICE_TOKEN"
+)
+
+// passphraseCommand runs the command through the shell, so helpers such as
+// `pass show secrets` can be given with their arguments. Its stdout is the
+// passphrase, stdin and stderr are left to the helper.
+func passphraseCommand(command string) *exec.Cmd {
+	var cmd *exec.Cmd
+	if runtime.GOOS == "windows" {
+		cmd = exec.Command("cmd", "/C", command)
+	} else {
+		cmd = exec.Command("sh", "-c", command)
+	}
+	cmd.Stdin = os.Stdin
+	cmd.Stderr = os.Stderr
+	return cmd
+}
+
+// isTerminal returns true when stdin is a terminal someone can type into
+func isTerminal() bool {
+	return term.IsTerminal(int(os.Stdin.Fd()))
+}
+
+// prompt asks for a value on the terminal without echoing it
+func prompt(label string) ([]byte, error) {
+	if !isTerminal() {
+		return nil, fmt.Errorf("stdin is not a terminal, can't prompt for the %s", label)
+	}
+	fmt.Fprintf(os.Stderr, "%s: ", label)
+	value, err := term.ReadPassword(int(os.Stdin.Fd()))
+	fmt.Fprintln(os.Stderr)
+	return value, err
+}
+
+// promptTwice asks for a value and then for it again, to catch typos
+func promptTwice(label string) ([]byte, error) {
+	value, err := prompt(label)
+	if err != nil {
+		return nil, err
+	}
+	confirmation, err := prompt("confirm " + label)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(value, confirmation) {
+		return nil, fmt.Errorf("the %ss didn't match", label)
+	}
+	return value, nil
+}
+
+// readStdin the raw bytes piped in, a trailing newline is part of the value
+func readStdin() ([]byte, error) {
+	return ioutil.ReadAll(os.Stdin)
+}
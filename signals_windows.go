@@ -0,0 +1,16 @@
+package main
+
+import (
+	"os"
+)
+
+// forwardedSignals the signals exec passes on to the command it runs
+var forwardedSignals = []os.Signal{
+	os.Interrupt,
+}
+
+// deliveredByTerminal the console sends Ctrl-C to every process attached
+// to it, the command included
+func deliveredByTerminal(sig os.Signal) bool {
+	return true
+}